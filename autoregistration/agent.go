@@ -0,0 +1,97 @@
+package autoregistration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NewAgentClient creates the client used for all calls to the agent's extension api, configured with the agent url,
+// request timeout and, if configured, the CA bundle and client certificate to use for (m)TLS.
+func NewAgentClient() (*resty.Client, error) {
+	tlsConfig, err := newAgentTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := resty.New()
+	client.SetBaseURL(extensionconfig.Config.AgentUrl)
+	client.SetTimeout(time.Duration(extensionconfig.Config.AgentRequestTimeout) * time.Second)
+	client.SetTLSClientConfig(tlsConfig)
+	client.SetDisableWarn(true)
+	client.SetRetryCount(extensionconfig.Config.AgentRetryCount)
+	client.SetRetryWaitTime(time.Duration(extensionconfig.Config.AgentRetryWaitTime) * time.Millisecond)
+	client.SetRetryMaxWaitTime(time.Duration(extensionconfig.Config.AgentRetryMaxWaitTime) * time.Millisecond)
+	client.AddRetryCondition(isRetryableAgentResponse)
+	client.AddRetryHook(logAgentRetry)
+	return client, nil
+}
+
+func logAgentRetry(resp *resty.Response, err error) {
+	agentRetries.Inc()
+	if resp == nil || resp.Request == nil {
+		log.Warn().Err(err).Msg("Agent request failed. Retry.")
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Agent request %s %s failed (attempt %d). Retry.", resp.Request.Method, resp.Request.URL, resp.Request.Attempt)
+		return
+	}
+	log.Warn().Msgf("Agent request %s %s failed (attempt %d). Status: %s. Retry.", resp.Request.Method, resp.Request.URL, resp.Request.Attempt, resp.Status())
+}
+
+// isRetryableAgentResponse retries agent calls that failed because the agent was unreachable, overloaded or failed
+// internally. Other client errors, e.g. a rejected agent key, would fail again and are not retried.
+func isRetryableAgentResponse(resp *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp != nil && (resp.StatusCode() >= http.StatusInternalServerError || resp.StatusCode() == http.StatusTooManyRequests)
+}
+
+// logAgentError logs a failed agent response, telling rejected requests apart from agent failures. A rejected agent key
+// is logged with a hint to the configuration, as every further call will fail the same way.
+func logAgentError(resp *resty.Response, message string) {
+	agentErrors.WithLabelValues(strconv.Itoa(resp.StatusCode())).Inc()
+	switch {
+	case resp.StatusCode() == http.StatusUnauthorized || resp.StatusCode() == http.StatusForbidden:
+		log.Error().Msgf("%s. The agent rejected the agent key, check STEADYBIT_EXTENSION_AGENT_KEY. Status: %s", message, resp.Status())
+	case isRetryableAgentResponse(resp, nil):
+		log.Error().Msgf("%s after %d attempts. Status: %s", message, resp.Request.Attempt, resp.Status())
+	default:
+		log.Error().Msgf("%s. The agent rejected the request. Status: %s", message, resp.Status())
+	}
+}
+
+func newAgentTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if extensionconfig.Config.AgentCaFile != "" {
+		caBundle, err := os.ReadFile(extensionconfig.Config.AgentCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read agent CA bundle: %w", err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in agent CA bundle: %s", extensionconfig.Config.AgentCaFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if (extensionconfig.Config.AgentClientCertFile == "") != (extensionconfig.Config.AgentClientKeyFile == "") {
+		return nil, errors.New("agent client certificate and key need to be configured together")
+	}
+	if extensionconfig.Config.AgentClientCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(extensionconfig.Config.AgentClientCertFile, extensionconfig.Config.AgentClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load agent client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
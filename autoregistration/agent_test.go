@@ -0,0 +1,134 @@
+package autoregistration
+
+import (
+	"encoding/pem"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_NewAgentClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caBundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		spec          config.Specification
+		wantCreateErr bool
+		wantCallErr   bool
+	}{
+		{
+			name:        "Should reject agent certificate without CA bundle",
+			spec:        config.Specification{AgentUrl: server.URL, AgentRequestTimeout: 1},
+			wantCallErr: true,
+		},
+		{
+			name: "Should trust agent certificate with CA bundle",
+			spec: config.Specification{AgentUrl: server.URL, AgentRequestTimeout: 1, AgentCaFile: caFile},
+		},
+		{
+			name:          "Should fail if CA bundle is missing",
+			spec:          config.Specification{AgentUrl: server.URL, AgentCaFile: filepath.Join(t.TempDir(), "missing.pem")},
+			wantCreateErr: true,
+		},
+		{
+			name:          "Should fail if client key is missing",
+			spec:          config.Specification{AgentUrl: server.URL, AgentClientCertFile: caFile},
+			wantCreateErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config = tt.spec
+			client, err := NewAgentClient()
+			if (err != nil) != tt.wantCreateErr {
+				t.Fatalf("NewAgentClient() error = %v, wantErr %v", err, tt.wantCreateErr)
+			}
+			if err != nil {
+				return
+			}
+			_, err = client.R().Get("/extensions")
+			if (err != nil) != tt.wantCallErr {
+				t.Errorf("client.Get() error = %v, wantErr %v", err, tt.wantCallErr)
+			}
+		})
+	}
+}
+
+func Test_NewAgentClient_retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantStatus   int
+		wantAttempts int
+	}{
+		{
+			name:         "Should retry server errors",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+		},
+		{
+			name:         "Should give up after configured retries",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 3,
+		},
+		{
+			name:         "Should retry too many requests",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "Should not retry rejected agent key",
+			statuses:     []int{http.StatusUnauthorized, http.StatusOK},
+			wantStatus:   http.StatusUnauthorized,
+			wantAttempts: 1,
+		},
+		{
+			name:         "Should not retry other client errors",
+			statuses:     []int{http.StatusBadRequest, http.StatusOK},
+			wantStatus:   http.StatusBadRequest,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[attempts])
+				attempts++
+			}))
+			defer server.Close()
+			config.Config = config.Specification{AgentUrl: server.URL, AgentRequestTimeout: 1, AgentRetryCount: 2, AgentRetryWaitTime: 1, AgentRetryMaxWaitTime: 5}
+			defer func() { config.Config = config.Specification{} }()
+			client, err := NewAgentClient()
+			if err != nil {
+				t.Fatalf("NewAgentClient() error = %v", err)
+			}
+
+			resp, err := client.R().Post("/extensions")
+			if err != nil {
+				t.Fatalf("client.Post() error = %v", err)
+			}
+			if resp.StatusCode() != tt.wantStatus {
+				t.Errorf("client.Post() status = %v, want %v", resp.StatusCode(), tt.wantStatus)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %v, want %v", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -2,51 +2,78 @@ package autoregistration
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog/log"
 	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var (
-	hostIpCache map[string]string
+const (
+	maxDescribeTasksBatchSize = 100
 )
 
 type EcsApi interface {
 	ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error)
 	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
 	DescribeContainerInstances(ctx context.Context, params *ecs.DescribeContainerInstancesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error)
+	DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error)
 }
 
 type Ec2Api interface {
 	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
 }
 
-func UpdateAgentExtensions(httpClient *resty.Client, ecsClient *EcsApi, ec2Client *Ec2Api) {
-	currentRegistrations, err := getCurrentRegistrations(httpClient)
-	if err == nil {
-		discoveredExtensions := discoverExtensions(ecsClient, ec2Client)
-		syncRegistrations(httpClient, &currentRegistrations, &discoveredExtensions)
+// EcsCluster bundles the AWS clients used to discover the extensions of a single ECS cluster.
+type EcsCluster struct {
+	Name      string
+	EcsClient *EcsApi
+	Ec2Client *Ec2Api
+}
+
+// UpdateAgentExtensions runs a single sync of the discovered extensions with the registrations at the agent. It returns
+// an error if the agent could not be reached, the discovery was incomplete or any registration change failed.
+func UpdateAgentExtensions(ctx context.Context, httpClient *resty.Client, clusters []EcsCluster) error {
+	currentRegistrations, err := getCurrentRegistrations(ctx, httpClient)
+	if err != nil {
+		health.recordCycle(time.Now(), false, false)
+		return err
+	}
+	discoveredExtensions, err := discoverExtensions(ctx, clusters)
+	if ctx.Err() != nil {
+		log.Info().Msg("Sync was cancelled. Skip.")
+		return ctx.Err()
 	}
+	recordRegisteredExtensions(&currentRegistrations, &discoveredExtensions)
+	syncErr := syncRegistrations(ctx, httpClient, &currentRegistrations, &discoveredExtensions, err == nil)
+	health.recordCycle(time.Now(), true, err == nil)
+	return errors.Join(err, syncErr)
 }
 
-func getCurrentRegistrations(httpClient *resty.Client) ([]extensionConfigAO, error) {
+func getCurrentRegistrations(ctx context.Context, httpClient *resty.Client) ([]extensionConfigAO, error) {
 	var currentRegistrations *[]extensionConfigAO
+	done := observeApiCall(apiAgent, "GetExtensions")
 	resp, err := httpClient.R().
+		SetContext(ctx).
 		SetHeader("Accept", "application/json").
 		SetResult(&currentRegistrations).
 		Get("/extensions")
+	done()
 
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get extension registrations from the agent. Skip.")
 		return nil, err
 	}
 	if resp.IsError() {
-		log.Error().Msgf("Failed to get extension registrations from the agent: %s. Skip.", resp.Status())
+		logAgentError(resp, "Failed to get extension registrations from the agent. Skip")
 		return nil, fmt.Errorf("failed to get extension registrations from the agent: %s", resp.Status())
 	}
 	if resp.IsSuccess() {
@@ -55,124 +82,486 @@ func getCurrentRegistrations(httpClient *resty.Client) ([]extensionConfigAO, err
 	return *currentRegistrations, nil
 }
 
-func discoverExtensions(ecsClient *EcsApi, ec2Client *Ec2Api) []extensionConfigAO {
+// discoverExtensions discovers the extensions in all clusters, depending on the discovery mode either by task family or
+// by tag, and merges them into one set in the order of the configured clusters. Clusters are discovered concurrently. If
+// the discovery of any family or service fails, the extensions discovered so far are returned together with an error,
+// signalling that the result is incomplete.
+func discoverExtensions(ctx context.Context, clusters []EcsCluster) ([]extensionConfigAO, error) {
+	discoveryStart := time.Now()
+	ctx, awsCalls := withAwsCallBudget(ctx)
+	defer func() { awsCallsPerSync.Set(float64(awsCalls.used())) }()
+	clusterExtensions := make([][]extensionConfigAO, len(clusters))
+	errs := make([]error, len(clusters))
+	forEachConcurrently(len(clusters), func(i int) {
+		clusterDiscoveryStart := time.Now()
+		if extensionconfig.Config.DiscoveryMode == extensionconfig.DiscoveryModeTags {
+			clusterExtensions[i], errs[i] = discoverTaggedTasks(ctx, clusters[i])
+		} else {
+			clusterExtensions[i], errs[i] = discoverTaskFamilies(ctx, clusters[i])
+		}
+		if errs[i] == nil {
+			hostIps.evictUnused(clusters[i].Name, clusterDiscoveryStart)
+		}
+	})
 	discoveredExtensions := make([]extensionConfigAO, 0)
-	for _, taskFamily := range extensionconfig.Config.TaskFamilies {
-		listTasksOutput, err := (*ecsClient).ListTasks(context.TODO(), &ecs.ListTasksInput{
-			Cluster:       &extensionconfig.Config.EcsClusterName,
-			DesiredStatus: types.DesiredStatusRunning,
-			Family:        &taskFamily,
-		})
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to list tasks. No extensions discovered.")
-			return discoveredExtensions
-		}
-		if len(listTasksOutput.TaskArns) > 0 {
-			describeTasksOutput, err := (*ecsClient).DescribeTasks(context.TODO(), &ecs.DescribeTasksInput{
-				Cluster: &extensionconfig.Config.EcsClusterName,
-				Tasks:   listTasksOutput.TaskArns,
-				Include: []types.TaskField{types.TaskFieldTags},
-			})
-			if err != nil {
-				log.Warn().Err(err).Msg("Failed to describe tasks. No extensions discovered.")
-				return discoveredExtensions
-			}
-			for _, task := range describeTasksOutput.Tasks {
-				portTag := getTagValue(task.Tags, "steadybit_extension_port")
-				if portTag == nil {
-					log.Warn().Msgf("Task: %s %s - Tag 'steadybit_extension_port' not found. Ignore.", *task.Group, *task.TaskArn)
-					continue
-				}
-				typesTag := getTagValue(task.Tags, "steadybit_extension_type")
-				if typesTag == nil {
-					log.Warn().Msgf("Task: %s %s - Tag 'steadybit_extension_type' not found. Ignore.", *task.Group, *task.TaskArn)
-					continue
-				}
-				daemonTag := getTagValue(task.Tags, "steadybit_extension_daemon")
+	for _, extensions := range clusterExtensions {
+		discoveredExtensions = append(discoveredExtensions, extensions...)
+	}
+	err := errors.Join(errs...)
+	if err == nil {
+		taskDefinitions.evictUnused(discoveryStart)
+	}
+	return discoveredExtensions, err
+}
 
-				var ip *string
-				if daemonTag != nil && *daemonTag == "true" {
-					ip = getHostIp(*task.ContainerInstanceArn, ecsClient, ec2Client)
-				} else if len(task.Containers[0].NetworkInterfaces) > 0 {
-					ip = task.Containers[0].NetworkInterfaces[0].PrivateIpv4Address
-				}
-				if ip != nil {
-					typesArray := strings.Split(*typesTag, ":")
-					discoveredExtensions = append(discoveredExtensions, extensionConfigAO{
-						Url:   "http://" + *ip + ":" + *portTag,
-						Types: typesArray,
-					})
-					log.Debug().Msgf("Discovered Task: %s - %s:%s - %v", *task.Group, *ip, *portTag, typesArray)
-				} else {
-					log.Warn().Msgf("Task: %s %s - No IP/Port found. Ignore.", *task.Group, *task.TaskArn)
-				}
-			}
+// discoverTaskFamilies discovers the extensions of all configured task families in the given cluster concurrently and
+// merges them in the order of the configured families.
+func discoverTaskFamilies(ctx context.Context, cluster EcsCluster) ([]extensionConfigAO, error) {
+	taskFamilies := extensionconfig.Config.TaskFamilies
+	familyExtensions := make([][]extensionConfigAO, len(taskFamilies))
+	errs := make([]error, len(taskFamilies))
+	forEachConcurrently(len(taskFamilies), func(i int) {
+		extensions, err := discoverTaskFamily(ctx, cluster, taskFamilies[i])
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to discover extensions of task family: %s in cluster: %s. Discovery is incomplete.", taskFamilies[i], cluster.Name)
+			errs[i] = fmt.Errorf("cluster %s, task family %s: %w", cluster.Name, taskFamilies[i], err)
+			discoveryFailures.WithLabelValues(cluster.Name, taskFamilies[i]).Inc()
 		} else {
-			log.Debug().Msgf("No tasks found for family: %s", taskFamily)
+			recordDiscoveredExtensions(cluster.Name, taskFamilies[i], len(extensions))
 		}
+		familyExtensions[i] = extensions
+	})
+	discoveredExtensions := make([]extensionConfigAO, 0)
+	for _, extensions := range familyExtensions {
+		discoveredExtensions = append(discoveredExtensions, extensions...)
 	}
-	return discoveredExtensions
+	return discoveredExtensions, errors.Join(errs...)
 }
 
-func syncRegistrations(httpClient *resty.Client, currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO) {
-	removeMissingRegistrations(httpClient, currentRegistrations, discoveredExtensions)
-	addNewRegistrations(httpClient, currentRegistrations, discoveredExtensions)
+func discoverTaskFamily(ctx context.Context, cluster EcsCluster, taskFamily string) ([]extensionConfigAO, error) {
+	discoveredExtensions := make([]extensionConfigAO, 0)
+	taskArns, err := listTaskArns(ctx, cluster, &ecs.ListTasksInput{Family: &taskFamily})
+	if err != nil {
+		return discoveredExtensions, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	if len(taskArns) == 0 {
+		log.Debug().Msgf("No tasks found for family: %s in cluster: %s", taskFamily, cluster.Name)
+		return discoveredExtensions, nil
+	}
+	tasks, err := describeTasks(ctx, cluster, taskArns)
+	if err != nil {
+		return discoveredExtensions, fmt.Errorf("failed to describe tasks: %w", err)
+	}
+	discoveredExtensions, err = toExtensions(ctx, cluster, tasks)
+	for i := range discoveredExtensions {
+		discoveredExtensions[i].TaskFamily = taskFamily
+	}
+	return discoveredExtensions, err
 }
 
-func removeMissingRegistrations(httpClient *resty.Client, currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO) {
-	for _, currentRegistration := range *currentRegistrations {
-		found := false
-		for _, discoveredExtension := range *discoveredExtensions {
-			if currentRegistration.Url == discoveredExtension.Url {
-				found = true
-				break
-			}
+// toExtensions builds the registrations of the given tasks. The task family of each extension is taken from its task
+// definition.
+func toExtensions(ctx context.Context, cluster EcsCluster, tasks []types.Task) ([]extensionConfigAO, error) {
+	extensions := make([]extensionConfigAO, 0, len(tasks))
+	// Resolve the host ips of all daemon and bridge tasks at once, so they are served from the cache afterwards
+	if _, err := hostIps.resolve(ctx, cluster, hostIpContainerInstanceArns(ctx, cluster, tasks)); err != nil {
+		return extensions, fmt.Errorf("failed to resolve host ips: %w", err)
+	}
+	var errs []error
+	for _, task := range tasks {
+		extension, err := buildExtension(ctx, cluster, task, true)
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
-		if !found {
-			resp, err := httpClient.R().
-				SetHeader("Content-Type", "application/json").
-				SetBasicAuth("_", extensionconfig.Config.AgentKey).
-				SetBody(currentRegistration).
-				Delete("/extensions")
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to remove extension: %s", currentRegistration.Url)
-			}
-			if resp.IsError() {
-				log.Error().Msgf("Failed to remove extension: %s. Status: %s", currentRegistration.Url, resp.Status())
-			}
-			if resp.IsSuccess() {
-				log.Info().Msgf("Removed extension: %s", currentRegistration.Url)
+		if extension != nil {
+			if task.TaskDefinitionArn != nil {
+				extension.TaskFamily = taskFamily(*task.TaskDefinitionArn)
 			}
+			extensions = append(extensions, *extension)
 		}
 	}
+	return extensions, errors.Join(errs...)
 }
 
-func addNewRegistrations(httpClient *resty.Client, currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO) {
-	for _, discoveredExtension := range *discoveredExtensions {
-		found := false
-		for _, currentRegistration := range *currentRegistrations {
-			if currentRegistration.Url == discoveredExtension.Url {
-				found = true
-				break
-			}
+// buildExtension builds the registration of the given task from its tags or container labels. Tasks that are not
+// (properly) tagged or labelled, not running or not healthy are ignored and nil is returned. The status and health
+// filters are only applied if filterStatus is set, a stopping task still needs its registration to be found and removed.
+func buildExtension(ctx context.Context, cluster EcsCluster, task types.Task, filterStatus bool) (*extensionConfigAO, error) {
+	if filterStatus && extensionconfig.Config.RequireRunning && (task.LastStatus == nil || *task.LastStatus != "RUNNING") {
+		log.Info().Msgf("Task: %s %s - Not running yet (last status: %s). Ignore.", *task.Group, *task.TaskArn, aws.ToString(task.LastStatus))
+		tasksSkipped.WithLabelValues(skipReasonNotRunning).Inc()
+		return nil, nil
+	}
+	if filterStatus && !isHealthStatusAccepted(task.HealthStatus) {
+		log.Info().Msgf("Task: %s %s - Not healthy (health status: %s). Ignore.", *task.Group, *task.TaskArn, task.HealthStatus)
+		tasksSkipped.WithLabelValues(skipReasonUnhealthy).Inc()
+		return nil, nil
+	}
+	metadata, err := getTaskMetadata(ctx, cluster, task)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the docker labels of task %s from its task definition: %w", *task.TaskArn, err)
+	}
+	metadata.port, err = getExtensionPort(ctx, cluster, task, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the extension port of task %s from its port mappings: %w", *task.TaskArn, err)
+	}
+	if metadata.port == nil {
+		log.Warn().Msgf("Task: %s %s - Tag '%s' or label '%s' not found and no port mapping to fall back to. Ignore.", *task.Group, *task.TaskArn, tagPort, labelPort)
+		tasksSkipped.WithLabelValues(skipReasonNoPort).Inc()
+		return nil, nil
+	}
+	if metadata.types == nil {
+		log.Warn().Msgf("Task: %s %s - Tag '%s' or label '%s' not found. Ignore.", *task.Group, *task.TaskArn, tagTypes, labelTypes)
+		tasksSkipped.WithLabelValues(skipReasonNoTypes).Inc()
+		return nil, nil
+	}
+	container := getExtensionContainer(ctx, cluster, task, metadata)
+	if filterStatus && container != nil && !isHealthStatusAccepted(container.HealthStatus) {
+		log.Info().Msgf("Task: %s %s - Extension container not healthy (health status: %s). Ignore.", *task.Group, *task.TaskArn, container.HealthStatus)
+		tasksSkipped.WithLabelValues(skipReasonUnhealthy).Inc()
+		return nil, nil
+	}
+	var ip *string
+	if metadata.isDaemon() {
+		if isFargate(task) || task.ContainerInstanceArn == nil {
+			log.Warn().Msgf("Task: %s %s - Tagged as daemon, but not running on an EC2 container instance (launch type: %s). Misconfigured, ignore.", *task.Group, *task.TaskArn, task.LaunchType)
+			tasksSkipped.WithLabelValues(skipReasonMisconfiguredDaemon).Inc()
+			return nil, nil
+		}
+		ip, err = getHostIp(ctx, cluster, *task.ContainerInstanceArn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve host ip of task %s: %w", *task.TaskArn, err)
+		}
+	} else if usesHostNetwork(task) && !isFargate(task) && task.ContainerInstanceArn != nil {
+		// In bridge and host network mode, the extension is reached via the container instance and the host port
+		ip, err = getHostIp(ctx, cluster, *task.ContainerInstanceArn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve host ip of task %s: %w", *task.TaskArn, err)
+		}
+	} else {
+		ip = getTaskIp(task, container)
+	}
+	if ip == nil {
+		log.Warn().Msgf("Task: %s %s - No IP/Port found. Ignore.", *task.Group, *task.TaskArn)
+		tasksSkipped.WithLabelValues(skipReasonNoIp).Inc()
+		return nil, nil
+	}
+	// Tags do not allow commas, so the types are separated by colons, while labels may use either
+	typesArray := strings.FieldsFunc(*metadata.types, func(r rune) bool {
+		return r == ':' || r == ','
+	})
+	scheme := getScheme(metadata)
+	if scheme != schemeHttp && scheme != schemeHttps {
+		log.Warn().Msgf("Task: %s %s - Scheme '%s' is neither 'http' nor 'https'. Ignore.", *task.Group, *task.TaskArn, scheme)
+		tasksSkipped.WithLabelValues(skipReasonInvalidScheme).Inc()
+		return nil, nil
+	}
+	port := getHostPort(task, container, *metadata.port)
+	log.Debug().Msgf("Discovered Task: %s/%s - %s://%s:%s - %v", cluster.Name, *task.Group, scheme, *ip, port, typesArray)
+	return &extensionConfigAO{
+		Url:     scheme + "://" + *ip + ":" + port,
+		Types:   typesArray,
+		Cluster: cluster.Name,
+	}, nil
+}
+
+// listTaskArns returns the ARNs of all running tasks of the cluster matching the given filter (e.g. family or service
+// name), following every page of ListTasks.
+func listTaskArns(ctx context.Context, cluster EcsCluster, filter *ecs.ListTasksInput) ([]string, error) {
+	taskArns := make([]string, 0)
+	input := *filter
+	input.Cluster = &cluster.Name
+	input.DesiredStatus = types.DesiredStatusRunning
+	paginator := ecs.NewListTasksPaginator(*cluster.EcsClient, &input)
+	for paginator.HasMorePages() {
+		done := observeApiCall(apiEcs, "ListTasks")
+		callCtx, cancel := withAwsTimeout(ctx)
+		listTasksOutput, err := paginator.NextPage(callCtx)
+		cancel()
+		done()
+		if err != nil {
+			return nil, err
+		}
+		taskArns = append(taskArns, listTasksOutput.TaskArns...)
+	}
+	return taskArns, nil
+}
+
+// describeTasks describes the given tasks in batches, as DescribeTasks accepts at most maxDescribeTasksBatchSize tasks per call.
+func describeTasks(ctx context.Context, cluster EcsCluster, taskArns []string) ([]types.Task, error) {
+	tasks := make([]types.Task, 0, len(taskArns))
+	for batch := range slices.Chunk(taskArns, maxDescribeTasksBatchSize) {
+		done := observeApiCall(apiEcs, "DescribeTasks")
+		callCtx, cancel := withAwsTimeout(ctx)
+		describeTasksOutput, err := (*cluster.EcsClient).DescribeTasks(callCtx, &ecs.DescribeTasksInput{
+			Cluster: &cluster.Name,
+			Tasks:   batch,
+			Include: []types.TaskField{types.TaskFieldTags},
+		})
+		cancel()
+		done()
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, describeTasksOutput.Tasks...)
+	}
+	return tasks, nil
+}
+
+// syncRegistrations adds all discovered extensions that are not yet registered at the agent. Registrations that were not
+// discovered are only removed if the discovery was complete, so a failed AWS call never wipes out existing registrations.
+// Only registrations owned by this sidecar are removed, unless it is configured to manage all registrations. If probing
+// is enabled, unhealthy extensions are treated as not discovered.
+func syncRegistrations(ctx context.Context, httpClient *resty.Client, currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO, discoveryComplete bool) error {
+	return applyPlan(ctx, httpClient, planSync(ctx, currentRegistrations, discoveredExtensions, discoveryComplete))
+}
+
+func containsUrl(registrations *[]extensionConfigAO, url string) bool {
+	return findRegistration(registrations, url) != nil
+}
+
+func findRegistration(registrations *[]extensionConfigAO, url string) *extensionConfigAO {
+	index := slices.IndexFunc(*registrations, func(registration extensionConfigAO) bool {
+		return registration.Url == url
+	})
+	if index < 0 {
+		return nil
+	}
+	return &(*registrations)[index]
+}
+
+// registrationChanged compares the url, unix socket and types of two registrations. The order of the types is ignored.
+func registrationChanged(currentRegistration extensionConfigAO, registration extensionConfigAO) bool {
+	return currentRegistration.Url != registration.Url ||
+		currentRegistration.UnixSocket != registration.UnixSocket ||
+		!slices.Equal(sortedTypes(currentRegistration), sortedTypes(registration))
+}
+
+func sortedTypes(registration extensionConfigAO) []string {
+	sorted := slices.Clone(registration.Types)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// describeChanges lists the changed fields of a registration for logging, e.g. `types: [ACTION] -> [ACTION DISCOVERY]`.
+func describeChanges(currentRegistration extensionConfigAO, registration extensionConfigAO) string {
+	changes := make([]string, 0)
+	if currentRegistration.Url != registration.Url {
+		changes = append(changes, fmt.Sprintf("url: %s -> %s", currentRegistration.Url, registration.Url))
+	}
+	if currentRegistration.UnixSocket != registration.UnixSocket {
+		changes = append(changes, fmt.Sprintf("unix socket: %s -> %s", currentRegistration.UnixSocket, registration.UnixSocket))
+	}
+	if !slices.Equal(sortedTypes(currentRegistration), sortedTypes(registration)) {
+		changes = append(changes, fmt.Sprintf("types: %v -> %v", currentRegistration.Types, registration.Types))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// updateRegistration replaces the current registration of an extension by removing and adding it again, as the agent
+// has no update api.
+func updateRegistration(ctx context.Context, httpClient *resty.Client, currentRegistration extensionConfigAO, registration extensionConfigAO) bool {
+	log.Info().Msgf("Extension: %s (cluster: %s) changed. %s", registration.Url, registration.Cluster, describeChanges(currentRegistration, registration))
+	if removeRegistration(ctx, httpClient, currentRegistration) && addRegistration(ctx, httpClient, registration) {
+		registrationsUpdated.Inc()
+		return true
+	}
+	return false
+}
+
+func removeRegistration(ctx context.Context, httpClient *resty.Client, registration extensionConfigAO) bool {
+	done := observeApiCall(apiAgent, "DeleteExtension")
+	resp, err := httpClient.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBasicAuth("_", extensionconfig.Config.AgentKey).
+		SetBody(registration).
+		Delete("/extensions")
+	done()
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to remove extension: %s", registration.Url)
+		registrationsFailed.WithLabelValues(operationRemove).Inc()
+	}
+	if resp.IsError() {
+		logAgentError(resp, fmt.Sprintf("Failed to remove extension: %s", registration.Url))
+		registrationsFailed.WithLabelValues(operationRemove).Inc()
+	}
+	if resp.IsSuccess() {
+		log.Info().Msgf("Removed extension: %s", registration.Url)
+		registrationsRemoved.Inc()
+		disown(registration.Url)
+
+		return true
+	}
+	return false
+}
+
+func addRegistration(ctx context.Context, httpClient *resty.Client, registration extensionConfigAO) bool {
+	if !isTlsReachable(ctx, registration) {
+		registrationsFailed.WithLabelValues(operationAdd).Inc()
+		return false
+	}
+	done := observeApiCall(apiAgent, "PostExtension")
+	resp, err := httpClient.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBasicAuth("_", extensionconfig.Config.AgentKey).
+		SetBody(registration).
+		Post("/extensions")
+	done()
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to add extension: %s (cluster: %s)", registration.Url, registration.Cluster)
+		registrationsFailed.WithLabelValues(operationAdd).Inc()
+	}
+	if resp.IsError() {
+		logAgentError(resp, fmt.Sprintf("Failed to add extension: %s (cluster: %s)", registration.Url, registration.Cluster))
+		registrationsFailed.WithLabelValues(operationAdd).Inc()
+	}
+	if resp.IsSuccess() {
+		log.Info().Msgf("Added extension: %s (cluster: %s)", registration.Url, registration.Cluster)
+		registrationsAdded.Inc()
+		own(registration)
+
+		return true
+	}
+	return false
+}
+
+// withAwsTimeout derives the context of a single AWS api call, limited by the configured request timeout.
+func withAwsTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(extensionconfig.Config.AwsRequestTimeout)*time.Second)
+}
+
+// hostIpContainerInstanceArns returns the container instances of all tasks running on EC2 that are reached via the host
+// ip, i.e. daemon tasks and tasks in bridge or host network mode. Tasks whose metadata cannot be read are left out, the
+// error is reported when building their registration.
+func hostIpContainerInstanceArns(ctx context.Context, cluster EcsCluster, tasks []types.Task) []string {
+	containerInstanceArns := make([]string, 0)
+	for _, task := range tasks {
+		if isFargate(task) || task.ContainerInstanceArn == nil {
+			continue
+		}
+		if usesHostNetwork(task) {
+			containerInstanceArns = append(containerInstanceArns, *task.ContainerInstanceArn)
+		} else if metadata, err := getTaskMetadata(ctx, cluster, task); err == nil && metadata.isDaemon() {
+			containerInstanceArns = append(containerInstanceArns, *task.ContainerInstanceArn)
 		}
-		if !found {
-			resp, err := httpClient.R().
-				SetHeader("Content-Type", "application/json").
-				SetBasicAuth("_", extensionconfig.Config.AgentKey).
-				SetBody(discoveredExtension).
-				Post("/extensions")
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to add extension: %s", discoveredExtension.Url)
+	}
+	return containerInstanceArns
+}
+
+// isHealthStatusAccepted reports whether a task or container with the given health status may be registered. Without a
+// health check, the status is UNKNOWN.
+func isHealthStatusAccepted(healthStatus types.HealthStatus) bool {
+	if !extensionconfig.Config.RequireHealthy || healthStatus == types.HealthStatusHealthy {
+		return true
+	}
+	return (healthStatus == types.HealthStatusUnknown || healthStatus == "") && extensionconfig.Config.AcceptUnknownHealth
+}
+
+// isFargate reports whether the task runs on Fargate, either launched directly or via a Fargate capacity provider.
+func isFargate(task types.Task) bool {
+	if task.LaunchType == types.LaunchTypeFargate {
+		return true
+	}
+	return task.CapacityProviderName != nil && (*task.CapacityProviderName == "FARGATE" || *task.CapacityProviderName == "FARGATE_SPOT")
+}
+
+// getTaskIp returns the ip of the extension container of a non-daemon awsvpc task. If the network interfaces of the container are
+// not populated, the ip of the task's elastic network interface attachment (awsvpc) is used.
+func getTaskIp(task types.Task, container *types.Container) *string {
+	if container == nil {
+		return nil
+	}
+	if len(container.NetworkInterfaces) > 0 && container.NetworkInterfaces[0].PrivateIpv4Address != nil {
+		return container.NetworkInterfaces[0].PrivateIpv4Address
+	}
+	for _, attachment := range task.Attachments {
+		if attachment.Type != nil && *attachment.Type == "ElasticNetworkInterface" {
+			if ip := getDetailValue(attachment.Details, "privateIPv4Address"); ip != nil {
+				return ip
 			}
-			if resp.IsError() {
-				log.Error().Msgf("Failed to add extension: %s. Status: %s", discoveredExtension.Url, resp.Status())
+		}
+	}
+	return nil
+}
+
+// getExtensionContainer selects the container of the extension by the steadybit_extension_container tag or the container
+// carrying the labels. Otherwise, the container exposing the extension port is selected, either by its network bindings
+// or, as awsvpc tasks have none, by the port mappings of the task definition if the task has more than one container.
+// It falls back to the first container with a network interface, as all containers of an awsvpc task share the same ip.
+func getExtensionContainer(ctx context.Context, cluster EcsCluster, task types.Task, metadata taskMetadata) *types.Container {
+	if metadata.container != nil {
+		if container := findContainer(task, *metadata.container); container != nil {
+			return container
+		}
+		log.Warn().Msgf("Task: %s %s - Container '%s' not found.", *task.Group, *task.TaskArn, *metadata.container)
+		return nil
+	}
+	port := ""
+	if metadata.port != nil {
+		port = *metadata.port
+	}
+	for i, container := range task.Containers {
+		for _, binding := range container.NetworkBindings {
+			if binding.ContainerPort != nil && strconv.Itoa(int(*binding.ContainerPort)) == port {
+				return &task.Containers[i]
 			}
-			if resp.IsSuccess() {
-				log.Info().Msgf("Added extension: %s", discoveredExtension.Url)
+		}
+	}
+	if len(task.Containers) > 1 && task.TaskDefinitionArn != nil {
+		if container := findContainerByPortMapping(ctx, cluster, task, port); container != nil {
+			return container
+		}
+	}
+	for i, container := range task.Containers {
+		if len(container.NetworkInterfaces) > 0 {
+			return &task.Containers[i]
+		}
+	}
+	if len(task.Containers) > 0 {
+		return &task.Containers[0]
+	}
+	return nil
+}
+
+// findContainerByPortMapping returns the container whose definition maps the given port. If the task definition cannot
+// be described, nil is returned, so the caller falls back to selecting the container by its network interface.
+func findContainerByPortMapping(ctx context.Context, cluster EcsCluster, task types.Task, port string) *types.Container {
+	containerDefinitions, err := taskDefinitions.get(ctx, cluster, *task.TaskDefinitionArn)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Task: %s %s - Failed to describe task definition to select the extension container by its port mapping. Fall back to the first container.", aws.ToString(task.Group), *task.TaskArn)
+		return nil
+	}
+	for _, containerDefinition := range containerDefinitions {
+		for _, portMapping := range containerDefinition.PortMappings {
+			if containerDefinition.Name != nil && portMapping.ContainerPort != nil && strconv.Itoa(int(*portMapping.ContainerPort)) == port {
+				if container := findContainer(task, *containerDefinition.Name); container != nil {
+					return container
+				}
 			}
 		}
 	}
+	return nil
+}
+
+func findContainer(task types.Task, name string) *types.Container {
+	for i, container := range task.Containers {
+		if container.Name != nil && *container.Name == name {
+			return &task.Containers[i]
+		}
+	}
+	return nil
+}
+
+func getDetailValue(details []types.KeyValuePair, name string) *string {
+	for _, detail := range details {
+		if detail.Name != nil && *detail.Name == name {
+			return detail.Value
+		}
+	}
+	return nil
 }
 
 func getTagValue(tags []types.Tag, key string) *string {
@@ -184,35 +573,13 @@ func getTagValue(tags []types.Tag, key string) *string {
 	return nil
 }
 
-func getHostIp(containerInstanceArn string, ecsClient *EcsApi, ec2Client *Ec2Api) *string {
-	if hostIpCache == nil {
-		hostIpCache = make(map[string]string)
+func getHostIp(ctx context.Context, cluster EcsCluster, containerInstanceArn string) (*string, error) {
+	ips, err := hostIps.resolve(ctx, cluster, []string{containerInstanceArn})
+	if err != nil {
+		return nil, err
 	}
-	ip, ok := hostIpCache[containerInstanceArn]
-	if !ok {
-		containerInstance, err := (*ecsClient).DescribeContainerInstances(context.TODO(), &ecs.DescribeContainerInstancesInput{
-			Cluster:            &extensionconfig.Config.EcsClusterName,
-			ContainerInstances: []string{containerInstanceArn},
-		})
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to describe container instances.")
-			return nil
-		}
-		instanceId := containerInstance.ContainerInstances[0].Ec2InstanceId
-		describeInstancesOutput, err := (*ec2Client).DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
-			InstanceIds: []string{*instanceId},
-		})
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to describe ec2 instance.")
-			return nil
-		}
-		if (len(describeInstancesOutput.Reservations) == 0) || (len(describeInstancesOutput.Reservations[0].Instances) == 0) {
-			return nil
-		}
-		ip = *describeInstancesOutput.Reservations[0].Instances[0].PrivateIpAddress
-		hostIpCache[containerInstanceArn] = ip
-		return new(ip)
-	} else {
-		return new(ip)
+	if ip, ok := ips[containerInstanceArn]; ok {
+		return &ip, nil
 	}
+	return nil, nil
 }
@@ -2,12 +2,15 @@ package autoregistration
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/go-resty/resty/v2"
 	"github.com/jarcoal/httpmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/steadybit/extension-auto-registration-ecs/config"
 	"github.com/stretchr/testify/mock"
 	"net/http"
@@ -43,6 +46,14 @@ func (m *ecsClientApiMock) DescribeContainerInstances(ctx context.Context, param
 	return args.Get(0).(*ecs.DescribeContainerInstancesOutput), args.Error(1)
 }
 
+func (m *ecsClientApiMock) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ecs.DescribeTaskDefinitionOutput), args.Error(1)
+}
+
 type ec2ClientApiMock struct {
 	mock.Mock
 }
@@ -55,6 +66,36 @@ func (m *ec2ClientApiMock) DescribeInstances(ctx context.Context, params *ec2.De
 	return args.Get(0).(*ec2.DescribeInstancesOutput), args.Error(1)
 }
 
+func taskArn(i int) string {
+	return fmt.Sprintf("arn:aws:ecs:eu-central-1:123456789012:task/steadybit-extension-test/%d", i)
+}
+
+func replicaTask(i int) types.Task {
+	return types.Task{
+		TaskArn: new(taskArn(i)),
+		Group:   new("steadybit-extension-test"),
+		Containers: []types.Container{
+			{
+				NetworkInterfaces: []types.NetworkInterface{
+					{
+						PrivateIpv4Address: new(fmt.Sprintf("10.0.%d.%d", i/256, i%256)),
+					},
+				},
+			},
+		},
+		Tags: []types.Tag{
+			{
+				Key:   new("steadybit_extension_port"),
+				Value: new("8080"),
+			},
+			{
+				Key:   new("steadybit_extension_type"),
+				Value: new("ACTION:DISCOVERY"),
+			},
+		},
+	}
+}
+
 func Test_discoverExtensions(t *testing.T) {
 	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
 	type args struct {
@@ -62,9 +103,10 @@ func Test_discoverExtensions(t *testing.T) {
 		ec2Client func() Ec2Api
 	}
 	tests := []struct {
-		name string
-		args args
-		want []extensionConfigAO
+		name    string
+		args    args
+		want    []extensionConfigAO
+		wantErr bool
 	}{
 		{
 			name: "Should discover daemon extensions",
@@ -99,7 +141,8 @@ func Test_discoverExtensions(t *testing.T) {
 					ecsMock.On("DescribeContainerInstances", mock.Anything, mock.Anything, mock.Anything).Return(&ecs.DescribeContainerInstancesOutput{
 						ContainerInstances: []types.ContainerInstance{
 							{
-								Ec2InstanceId: new("i-1234567890abcdef0"),
+								ContainerInstanceArn: new("arn:aws:ecs:eu-central-1:123456789012:container-instance/12345678901234567890"),
+								Ec2InstanceId:        new("i-1234567890abcdef0"),
 							},
 						},
 					}, nil)
@@ -124,8 +167,82 @@ func Test_discoverExtensions(t *testing.T) {
 			},
 			want: []extensionConfigAO{
 				{
-					Url:   "http://111.222.333.444:8080",
-					Types: []string{"ACTION", "DISCOVERY"},
+					Url:        "http://111.222.333.444:8080",
+					Types:      []string{"ACTION", "DISCOVERY"},
+					Cluster:    "steadybit-cluster",
+					TaskFamily: "steadybit-extension-test",
+				},
+			},
+		},
+		{
+			name: "Should discover bridge extensions with dynamic host port",
+			args: args{
+				ecsClient: func() EcsApi {
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{
+						TaskArns: []string{taskArn(1)},
+					}, nil)
+					ecsMock.On("DescribeTasks", mock.Anything, mock.Anything, mock.Anything).Return(&ecs.DescribeTasksOutput{
+						Tasks: []types.Task{
+							{
+								ContainerInstanceArn: new("arn:aws:ecs:eu-central-1:123456789012:container-instance/12345678901234567890"),
+								TaskArn:              new(taskArn(1)),
+								Group:                new("steadybit-extension-test"),
+								Containers: []types.Container{
+									{
+										NetworkBindings: []types.NetworkBinding{
+											{
+												ContainerPort: new(int32(8080)),
+												HostPort:      new(int32(32768)),
+											},
+										},
+									},
+								},
+								Tags: []types.Tag{
+									{
+										Key:   new("steadybit_extension_port"),
+										Value: new("8080"),
+									},
+									{
+										Key:   new("steadybit_extension_type"),
+										Value: new("ACTION:DISCOVERY"),
+									}},
+							},
+						},
+					}, nil)
+					ecsMock.On("DescribeContainerInstances", mock.Anything, mock.Anything, mock.Anything).Return(&ecs.DescribeContainerInstancesOutput{
+						ContainerInstances: []types.ContainerInstance{
+							{
+								ContainerInstanceArn: new("arn:aws:ecs:eu-central-1:123456789012:container-instance/12345678901234567890"),
+								Ec2InstanceId:        new("i-1234567890abcdef0"),
+							},
+						},
+					}, nil)
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					ec2Mock.On("DescribeInstances", mock.Anything, mock.Anything, mock.Anything).Return(&ec2.DescribeInstancesOutput{
+						Reservations: []ec2types.Reservation{
+							{
+								Instances: []ec2types.Instance{
+									{
+										InstanceId:       new("i-1234567890abcdef0"),
+										PrivateIpAddress: new("111.222.333.444"),
+									},
+								},
+							},
+						},
+					}, nil)
+					return ec2Mock
+				},
+			},
+			want: []extensionConfigAO{
+				{
+					Url:        "http://111.222.333.444:32768",
+					Types:      []string{"ACTION", "DISCOVERY"},
+					Cluster:    "steadybit-cluster",
+					TaskFamily: "steadybit-extension-test",
 				},
 			},
 		},
@@ -174,8 +291,10 @@ func Test_discoverExtensions(t *testing.T) {
 			},
 			want: []extensionConfigAO{
 				{
-					Url:   "http://111.222.333.444:8080",
-					Types: []string{"ACTION", "DISCOVERY"},
+					Url:        "http://111.222.333.444:8080",
+					Types:      []string{"ACTION", "DISCOVERY"},
+					Cluster:    "steadybit-cluster",
+					TaskFamily: "steadybit-extension-test",
 				},
 			},
 		},
@@ -241,21 +360,280 @@ func Test_discoverExtensions(t *testing.T) {
 			},
 			want: []extensionConfigAO{},
 		},
+		{
+			name: "Should discover extensions from all pages of ListTasks",
+			args: args{
+				ecsClient: func() EcsApi {
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+						return input.NextToken == nil
+					})).Return(&ecs.ListTasksOutput{
+						TaskArns:  []string{taskArn(1)},
+						NextToken: new("page-2"),
+					}, nil)
+					ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+						return input.NextToken != nil && *input.NextToken == "page-2"
+					})).Return(&ecs.ListTasksOutput{
+						TaskArns: []string{taskArn(2)},
+					}, nil)
+					ecsMock.On("DescribeTasks", mock.Anything, mock.MatchedBy(func(input *ecs.DescribeTasksInput) bool {
+						return reflect.DeepEqual(input.Tasks, []string{taskArn(1), taskArn(2)})
+					})).Return(&ecs.DescribeTasksOutput{
+						Tasks: []types.Task{replicaTask(1), replicaTask(2)},
+					}, nil)
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					return ec2Mock
+				},
+			},
+			want: []extensionConfigAO{
+				{
+					Url:        "http://10.0.0.1:8080",
+					Types:      []string{"ACTION", "DISCOVERY"},
+					Cluster:    "steadybit-cluster",
+					TaskFamily: "steadybit-extension-test",
+				},
+				{
+					Url:        "http://10.0.0.2:8080",
+					Types:      []string{"ACTION", "DISCOVERY"},
+					Cluster:    "steadybit-cluster",
+					TaskFamily: "steadybit-extension-test",
+				},
+			},
+		},
+		{
+			name: "Should describe more than 100 tasks in batches",
+			args: args{
+				ecsClient: func() EcsApi {
+					taskArns := make([]string, 0, 150)
+					tasks := make([]types.Task, 0, 150)
+					for i := 1; i <= 150; i++ {
+						taskArns = append(taskArns, taskArn(i))
+						tasks = append(tasks, replicaTask(i))
+					}
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{
+						TaskArns: taskArns,
+					}, nil)
+					ecsMock.On("DescribeTasks", mock.Anything, mock.MatchedBy(func(input *ecs.DescribeTasksInput) bool {
+						return reflect.DeepEqual(input.Tasks, taskArns[:100])
+					})).Return(&ecs.DescribeTasksOutput{
+						Tasks: tasks[:100],
+					}, nil).Once()
+					ecsMock.On("DescribeTasks", mock.Anything, mock.MatchedBy(func(input *ecs.DescribeTasksInput) bool {
+						return reflect.DeepEqual(input.Tasks, taskArns[100:])
+					})).Return(&ecs.DescribeTasksOutput{
+						Tasks: tasks[100:],
+					}, nil).Once()
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					return ec2Mock
+				},
+			},
+			want: func() []extensionConfigAO {
+				want := make([]extensionConfigAO, 0, 150)
+				for i := 1; i <= 150; i++ {
+					want = append(want, extensionConfigAO{
+						Url:        fmt.Sprintf("http://10.0.%d.%d:8080", i/256, i%256),
+						Types:      []string{"ACTION", "DISCOVERY"},
+						Cluster:    "steadybit-cluster",
+						TaskFamily: "steadybit-extension-test",
+					})
+				}
+				return want
+			}(),
+		},
+		{
+			name: "Should ignore fargate task tagged as daemon",
+			args: args{
+				ecsClient: func() EcsApi {
+					task := replicaTask(1)
+					task.LaunchType = types.LaunchTypeFargate
+					task.Tags = append(task.Tags, types.Tag{Key: new("steadybit_extension_daemon"), Value: new("true")})
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{
+						TaskArns: []string{taskArn(1)},
+					}, nil)
+					ecsMock.On("DescribeTasks", mock.Anything, mock.Anything).Return(&ecs.DescribeTasksOutput{
+						Tasks: []types.Task{task},
+					}, nil)
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					return ec2Mock
+				},
+			},
+			want: []extensionConfigAO{},
+		},
+		{
+			name: "Should discover fargate task started by capacity provider",
+			args: args{
+				ecsClient: func() EcsApi {
+					task := replicaTask(1)
+					task.CapacityProviderName = new("FARGATE_SPOT")
+					task.Containers[0].NetworkInterfaces = nil
+					task.Attachments = []types.Attachment{
+						{
+							Type:    new("ElasticNetworkInterface"),
+							Details: []types.KeyValuePair{{Name: new("privateIPv4Address"), Value: new("10.0.0.1")}},
+						},
+					}
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{
+						TaskArns: []string{taskArn(1)},
+					}, nil)
+					ecsMock.On("DescribeTasks", mock.Anything, mock.Anything).Return(&ecs.DescribeTasksOutput{
+						Tasks: []types.Task{task},
+					}, nil)
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					return ec2Mock
+				},
+			},
+			want: []extensionConfigAO{
+				{
+					Url:        "http://10.0.0.1:8080",
+					Types:      []string{"ACTION", "DISCOVERY"},
+					Cluster:    "steadybit-cluster",
+					TaskFamily: "steadybit-extension-test",
+				},
+			},
+		},
+		{
+			name: "Should report incomplete discovery if listing tasks fails",
+			args: args{
+				ecsClient: func() EcsApi {
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(nil, errors.New("throttled"))
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					return ec2Mock
+				},
+			},
+			want:    []extensionConfigAO{},
+			wantErr: true,
+		},
+		{
+			name: "Should report incomplete discovery if describing tasks fails",
+			args: args{
+				ecsClient: func() EcsApi {
+					ecsMock := new(ecsClientApiMock)
+					ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{
+						TaskArns: []string{taskArn(1)},
+					}, nil)
+					ecsMock.On("DescribeTasks", mock.Anything, mock.Anything).Return(nil, errors.New("throttled"))
+					return ecsMock
+				},
+				ec2Client: func() Ec2Api {
+					ec2Mock := new(ec2ClientApiMock)
+					return ec2Mock
+				},
+			},
+			want:    []extensionConfigAO{},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := discoverExtensions(new(tt.args.ecsClient()), new(tt.args.ec2Client())); !reflect.DeepEqual(got, tt.want) {
+			got, err := discoverExtensions(context.Background(), []EcsCluster{{Name: "steadybit-cluster", EcsClient: new(tt.args.ecsClient()), Ec2Client: new(tt.args.ec2Client())}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("discoverExtensions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("discoverExtensions() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func Test_discoverExtensions_multipleClusters(t *testing.T) {
+	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
+	newCluster := func(name string, i int) EcsCluster {
+		ecsMock := new(ecsClientApiMock)
+		ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+			return *input.Cluster == name
+		})).Return(&ecs.ListTasksOutput{
+			TaskArns: []string{taskArn(i)},
+		}, nil)
+		ecsMock.On("DescribeTasks", mock.Anything, mock.MatchedBy(func(input *ecs.DescribeTasksInput) bool {
+			return *input.Cluster == name
+		})).Return(&ecs.DescribeTasksOutput{
+			Tasks: []types.Task{replicaTask(i)},
+		}, nil)
+		var ecsClient EcsApi = ecsMock
+		var ec2Client Ec2Api = new(ec2ClientApiMock)
+		return EcsCluster{Name: name, EcsClient: &ecsClient, Ec2Client: &ec2Client}
+	}
+
+	got, err := discoverExtensions(context.Background(), []EcsCluster{newCluster("cluster-a", 1), newCluster("cluster-b", 2)})
+
+	want := []extensionConfigAO{
+		{
+			Url:        "http://10.0.0.1:8080",
+			Types:      []string{"ACTION", "DISCOVERY"},
+			Cluster:    "cluster-a",
+			TaskFamily: "steadybit-extension-test",
+		},
+		{
+			Url:        "http://10.0.0.2:8080",
+			Types:      []string{"ACTION", "DISCOVERY"},
+			Cluster:    "cluster-b",
+			TaskFamily: "steadybit-extension-test",
+		},
+	}
+	if err != nil {
+		t.Errorf("discoverExtensions() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverExtensions() = %v, want %v", got, want)
+	}
+}
+
+func Test_discoverExtensions_failureKeepsDiscoveredExtensions(t *testing.T) {
+	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
+	ecsMock := new(ecsClientApiMock)
+	ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{
+		TaskArns: []string{taskArn(1)},
+	}, nil).Once()
+	ecsMock.On("DescribeTasks", mock.Anything, mock.Anything).Return(&ecs.DescribeTasksOutput{
+		Tasks: []types.Task{replicaTask(1)},
+	}, nil).Once()
+	ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(nil, errors.New("throttled"))
+	var ecsClient EcsApi = ecsMock
+	var ec2Client Ec2Api = new(ec2ClientApiMock)
+	clusters := []EcsCluster{{Name: "steadybit-cluster-failing", EcsClient: &ecsClient, Ec2Client: &ec2Client}}
+
+	if _, err := discoverExtensions(context.Background(), clusters); err != nil {
+		t.Fatalf("discoverExtensions() error = %v", err)
+	}
+	if _, err := discoverExtensions(context.Background(), clusters); err == nil {
+		t.Fatalf("discoverExtensions() error = nil, want error")
+	}
+
+	if got := testutil.ToFloat64(discoveredExtensionsGauge.WithLabelValues("steadybit-cluster-failing", "steadybit-extension-test")); got != 1 {
+		t.Errorf("discovered_extensions = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(discoveryFailures.WithLabelValues("steadybit-cluster-failing", "steadybit-extension-test")); got != 1 {
+		t.Errorf("discovery_failures_total = %v, want 1", got)
+	}
+}
+
 func Test_syncRegistrations(t *testing.T) {
 	type args struct {
 		httpClient           func() *resty.Client
 		currentRegistrations *[]extensionConfigAO
 		discoveredExtensions *[]extensionConfigAO
+		discoveryComplete    bool
+		ownedRegistrations   []string
 	}
 	tests := []struct {
 		name string
@@ -286,6 +664,7 @@ func Test_syncRegistrations(t *testing.T) {
 						Types: []string{"ACTION", "DISCOVERY"},
 					},
 				},
+				discoveryComplete: true,
 			},
 			want: map[string]int{
 				"POST http://localhost:42899/extensions <mock>": 1,
@@ -315,6 +694,8 @@ func Test_syncRegistrations(t *testing.T) {
 						Types: []string{"ACTION", "DISCOVERY"},
 					},
 				},
+				discoveryComplete:  true,
+				ownedRegistrations: []string{"http://111.222.333.444:8080"},
 			},
 			want: map[string]int{
 				"DELETE http://localhost:42899/extensions <mock>": 1,
@@ -341,17 +722,163 @@ func Test_syncRegistrations(t *testing.T) {
 						Types: []string{"ACTION", "DISCOVERY"},
 					},
 				},
+				discoveryComplete: true,
+			},
+			want: map[string]int{},
+		},
+		{
+			name: "Should update registrations with changed types",
+			args: args{
+				httpClient: func() *resty.Client {
+					client := resty.New()
+					client.SetBaseURL("http://localhost:42899")
+					httpmock.ActivateNonDefault(client.GetClient())
+					httpmock.RegisterMatcherResponder("DELETE", "http://localhost:42899/extensions",
+						httpmock.BodyContainsString(`{"url":"http://99.99.99.99:9999","types":["ACTION"]}`).WithName("mock"),
+						httpmock.NewStringResponder(200, ""))
+					httpmock.RegisterMatcherResponder("POST", "http://localhost:42899/extensions",
+						httpmock.BodyContainsString(`{"url":"http://99.99.99.99:9999","types":["ACTION","DISCOVERY"]}`).WithName("mock"),
+						httpmock.NewStringResponder(200, ""))
+					return client
+				},
+				currentRegistrations: &[]extensionConfigAO{
+					{
+						Url:   "http://99.99.99.99:9999",
+						Types: []string{"ACTION"},
+					},
+				},
+				discoveredExtensions: &[]extensionConfigAO{
+					{
+						Url:   "http://99.99.99.99:9999",
+						Types: []string{"ACTION", "DISCOVERY"},
+					},
+				},
+				discoveryComplete: true,
+			},
+			want: map[string]int{
+				"DELETE http://localhost:42899/extensions <mock>": 1,
+				"POST http://localhost:42899/extensions <mock>":   1,
+			},
+		},
+		{
+			name: "Should ignore order of types",
+			args: args{
+				httpClient: func() *resty.Client {
+					client := resty.New()
+					client.SetBaseURL("http://localhost:42899")
+					httpmock.ActivateNonDefault(client.GetClient())
+					return client
+				},
+				currentRegistrations: &[]extensionConfigAO{
+					{
+						Url:   "http://99.99.99.99:9999",
+						Types: []string{"DISCOVERY", "ACTION"},
+					},
+				},
+				discoveredExtensions: &[]extensionConfigAO{
+					{
+						Url:   "http://99.99.99.99:9999",
+						Types: []string{"ACTION", "DISCOVERY"},
+					},
+				},
+				discoveryComplete: true,
 			},
 			want: map[string]int{},
 		},
+		{
+			name: "Should not remove registrations if discovery was incomplete",
+			args: args{
+				httpClient: func() *resty.Client {
+					client := resty.New()
+					client.SetBaseURL("http://localhost:42899")
+					httpmock.ActivateNonDefault(client.GetClient())
+					httpmock.RegisterMatcherResponder("POST", "http://localhost:42899/extensions",
+						httpmock.BodyContainsString(`{"url":"http://99.99.99.99:9999","types":["ACTION","DISCOVERY"]}`).WithName("mock"),
+						httpmock.NewStringResponder(200, ""))
+					return client
+				},
+				currentRegistrations: &[]extensionConfigAO{
+					{
+						Url:   "http://111.222.333.444:8080",
+						Types: []string{"ACTION", "DISCOVERY"},
+					},
+				},
+				discoveredExtensions: &[]extensionConfigAO{
+					{
+						Url:   "http://99.99.99.99:9999",
+						Types: []string{"ACTION", "DISCOVERY"},
+					},
+				},
+				discoveryComplete:  false,
+				ownedRegistrations: []string{"http://111.222.333.444:8080"},
+			},
+			want: map[string]int{
+				"POST http://localhost:42899/extensions <mock>": 1,
+			},
+		},
+		{
+			name: "Should not remove registrations not owned",
+			args: args{
+				httpClient: func() *resty.Client {
+					client := resty.New()
+					client.SetBaseURL("http://localhost:42899")
+					httpmock.ActivateNonDefault(client.GetClient())
+					return client
+				},
+				currentRegistrations: &[]extensionConfigAO{
+					{
+						Url:   "http://111.222.333.444:8080",
+						Types: []string{"ACTION", "DISCOVERY"},
+					},
+					{
+						UnixSocket: "/run/steadybit/extension.sock",
+						Types:      []string{"ACTION"},
+					},
+				},
+				discoveredExtensions: &[]extensionConfigAO{},
+				discoveryComplete:    true,
+			},
+			want: map[string]int{},
+		},
+		{
+			name: "Should remove registrations not owned if managing all registrations",
+			args: args{
+				httpClient: func() *resty.Client {
+					client := resty.New()
+					client.SetBaseURL("http://localhost:42899")
+					httpmock.ActivateNonDefault(client.GetClient())
+					httpmock.RegisterMatcherResponder("DELETE", "http://localhost:42899/extensions",
+						httpmock.BodyContainsString(`{"url":"http://111.222.333.444:8080","types":["ACTION","DISCOVERY"]}`).WithName("mock"),
+						httpmock.NewStringResponder(200, ""))
+					config.Config.ManageAllRegistrations = true
+					return client
+				},
+				currentRegistrations: &[]extensionConfigAO{
+					{
+						Url:   "http://111.222.333.444:8080",
+						Types: []string{"ACTION", "DISCOVERY"},
+					},
+				},
+				discoveredExtensions: &[]extensionConfigAO{},
+				discoveryComplete:    true,
+			},
+			want: map[string]int{
+				"DELETE http://localhost:42899/extensions <mock>": 1,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			syncRegistrations(tt.args.httpClient(), tt.args.currentRegistrations, tt.args.discoveredExtensions)
+			clear(ownedRegistrations)
+			for _, url := range tt.args.ownedRegistrations {
+				own(extensionConfigAO{Url: url})
+			}
+			syncRegistrations(context.Background(), tt.args.httpClient(), tt.args.currentRegistrations, tt.args.discoveredExtensions, tt.args.discoveryComplete)
 			if got := httpmock.GetCallCountInfo(); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("httpmock.GetCallCountInfo() = %v, want %v", got, tt.want)
 			}
 			httpmock.Reset()
+			config.Config.ManageAllRegistrations = false
 		})
 	}
 }
@@ -389,7 +916,7 @@ func Test_getCurrentRegistrations(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _ := getCurrentRegistrations(tt.args.httpClient())
+			got, _ := getCurrentRegistrations(context.Background(), tt.args.httpClient())
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("getCurrentRegistrations() got = %v, want %v", got, tt.want)
 			}
@@ -397,3 +924,249 @@ func Test_getCurrentRegistrations(t *testing.T) {
 		})
 	}
 }
+
+func Test_getTaskIp(t *testing.T) {
+	sidecar := types.Container{
+		Name: new("log-router"),
+		NetworkInterfaces: []types.NetworkInterface{
+			{
+				PrivateIpv4Address: new("10.0.0.1"),
+			},
+		},
+	}
+	extension := types.Container{
+		Name: new("extension"),
+		NetworkBindings: []types.NetworkBinding{
+			{
+				ContainerPort: new(int32(8080)),
+			},
+		},
+		NetworkInterfaces: []types.NetworkInterface{
+			{
+				PrivateIpv4Address: new("10.0.0.2"),
+			},
+		},
+	}
+	withTags := func(task types.Task, tags ...types.Tag) types.Task {
+		task.TaskArn = new(taskArn(1))
+		task.Group = new("steadybit-extension-test")
+		task.Tags = tags
+		return task
+	}
+	tests := []struct {
+		name string
+		task types.Task
+		want *string
+	}{
+		{
+			name: "Should select container by tag",
+			task: withTags(types.Task{Containers: []types.Container{sidecar, extension}},
+				types.Tag{Key: new("steadybit_extension_container"), Value: new("extension")}),
+			want: new("10.0.0.2"),
+		},
+		{
+			name: "Should not fall back if tagged container is missing",
+			task: withTags(types.Task{Containers: []types.Container{sidecar}},
+				types.Tag{Key: new("steadybit_extension_container"), Value: new("extension")}),
+			want: nil,
+		},
+		{
+			name: "Should select container exposing the port",
+			task: withTags(types.Task{Containers: []types.Container{sidecar, extension}}),
+			want: new("10.0.0.2"),
+		},
+		{
+			name: "Should fall back to first container with network interface",
+			task: withTags(types.Task{Containers: []types.Container{{Name: new("init")}, sidecar}}),
+			want: new("10.0.0.1"),
+		},
+		{
+			name: "Should use ip of elastic network interface attachment",
+			task: withTags(types.Task{
+				Containers: []types.Container{{Name: new("extension")}},
+				Attachments: []types.Attachment{
+					{
+						Type: new("ElasticNetworkInterface"),
+						Details: []types.KeyValuePair{
+							{Name: new("subnetId"), Value: new("subnet-12345678")},
+							{Name: new("privateIPv4Address"), Value: new("10.0.0.3")},
+						},
+					},
+				},
+			}),
+			want: new("10.0.0.3"),
+		},
+		{
+			name: "Should not fail without containers",
+			task: withTags(types.Task{}),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := getExtensionContainer(context.Background(), EcsCluster{}, tt.task, tagMetadata(tt.task).or(taskMetadata{port: new("8080")}))
+			if got := getTaskIp(tt.task, container); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getTaskIp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getExtensionContainer_awsvpc(t *testing.T) {
+	clear(taskDefinitions.entries)
+	ecsMock := new(ecsClientApiMock)
+	ecsMock.On("DescribeTaskDefinition", mock.Anything, mock.Anything).Return(&ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &types.TaskDefinition{ContainerDefinitions: []types.ContainerDefinition{
+			{Name: new("envoy"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(15000))}}},
+			{Name: new("extension"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(8080))}}},
+		}},
+	}, nil)
+	var ecsClient EcsApi = ecsMock
+	cluster := EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient}
+	networkInterfaces := []types.NetworkInterface{{PrivateIpv4Address: new("10.0.0.1")}}
+	task := types.Task{
+		TaskArn:           new(taskArn(1)),
+		TaskDefinitionArn: new("arn:aws:ecs:eu-central-1:123456789012:task-definition/steadybit-extension-test:1"),
+		Containers: []types.Container{
+			{Name: new("envoy"), NetworkInterfaces: networkInterfaces, HealthStatus: types.HealthStatusUnhealthy},
+			{Name: new("extension"), NetworkInterfaces: networkInterfaces, HealthStatus: types.HealthStatusHealthy},
+		},
+	}
+
+	got := getExtensionContainer(context.Background(), cluster, task, taskMetadata{port: new("8080")})
+	if got == nil || *got.Name != "extension" {
+		t.Errorf("getExtensionContainer() = %v, want container extension", got)
+	}
+}
+
+func Test_buildExtension_taggedTaskWithTaskDefinition(t *testing.T) {
+	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
+	withContainers := func(names ...string) types.Task {
+		task := replicaTask(1)
+		task.TaskDefinitionArn = new("arn:aws:ecs:eu-central-1:123456789012:task-definition/steadybit-extension-test:1")
+		task.Containers = nil
+		for _, name := range names {
+			task.Containers = append(task.Containers, types.Container{
+				Name:              new(name),
+				NetworkInterfaces: []types.NetworkInterface{{PrivateIpv4Address: new("10.0.0.1")}},
+			})
+		}
+		return task
+	}
+	tests := []struct {
+		name                   string
+		task                   types.Task
+		wantTaskDefinitionCall bool
+	}{
+		{
+			name: "Should not describe the task definition of a tagged task with a single container",
+			task: withContainers("extension"),
+		},
+		{
+			name:                   "Should fall back to the first container if the task definition cannot be described",
+			task:                   withContainers("extension", "envoy"),
+			wantTaskDefinitionCall: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(taskDefinitions.entries)
+			ecsMock := new(ecsClientApiMock)
+			ecsMock.On("DescribeTaskDefinition", mock.Anything, mock.Anything).Return(nil, errors.New("AccessDeniedException"))
+			var ecsClient EcsApi = ecsMock
+			cluster := EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient}
+
+			got, err := buildExtension(context.Background(), cluster, tt.task, true)
+			if err != nil {
+				t.Fatalf("buildExtension() error = %v", err)
+			}
+			if got == nil || got.Url != "http://10.0.0.1:8080" {
+				t.Errorf("buildExtension() = %v, want extension http://10.0.0.1:8080", got)
+			}
+			if tt.wantTaskDefinitionCall {
+				ecsMock.AssertCalled(t, "DescribeTaskDefinition", mock.Anything, mock.Anything)
+			} else {
+				ecsMock.AssertNotCalled(t, "DescribeTaskDefinition", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func Test_buildExtension_status(t *testing.T) {
+	withStatus := func(lastStatus string, taskHealth types.HealthStatus, containerHealth types.HealthStatus) types.Task {
+		task := replicaTask(1)
+		task.LastStatus = new(lastStatus)
+		task.HealthStatus = taskHealth
+		task.Containers[0].HealthStatus = containerHealth
+		return task
+	}
+	tests := []struct {
+		name                string
+		requireHealthy      bool
+		acceptUnknownHealth bool
+		task                types.Task
+		wantRegistered      bool
+	}{
+		{
+			name:           "Should ignore task that is not running yet",
+			task:           withStatus("PENDING", types.HealthStatusUnknown, types.HealthStatusUnknown),
+			wantRegistered: false,
+		},
+		{
+			name:           "Should ignore health status by default",
+			task:           withStatus("RUNNING", types.HealthStatusUnhealthy, types.HealthStatusUnhealthy),
+			wantRegistered: true,
+		},
+		{
+			name:           "Should register healthy task",
+			requireHealthy: true,
+			task:           withStatus("RUNNING", types.HealthStatusHealthy, types.HealthStatusHealthy),
+			wantRegistered: true,
+		},
+		{
+			name:           "Should ignore unhealthy task",
+			requireHealthy: true,
+			task:           withStatus("RUNNING", types.HealthStatusUnhealthy, types.HealthStatusHealthy),
+			wantRegistered: false,
+		},
+		{
+			name:           "Should ignore task with unhealthy extension container",
+			requireHealthy: true,
+			task:           withStatus("RUNNING", types.HealthStatusHealthy, types.HealthStatusUnhealthy),
+			wantRegistered: false,
+		},
+		{
+			name:                "Should accept unknown health status if configured",
+			requireHealthy:      true,
+			acceptUnknownHealth: true,
+			task:                withStatus("RUNNING", types.HealthStatusUnknown, types.HealthStatusUnknown),
+			wantRegistered:      true,
+		},
+		{
+			name:           "Should ignore unknown health status if not accepted",
+			requireHealthy: true,
+			task:           withStatus("RUNNING", types.HealthStatusUnknown, types.HealthStatusUnknown),
+			wantRegistered: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.RequireRunning = true
+			config.Config.RequireHealthy = tt.requireHealthy
+			config.Config.AcceptUnknownHealth = tt.acceptUnknownHealth
+			defer func() {
+				config.Config.RequireRunning = false
+				config.Config.RequireHealthy = false
+				config.Config.AcceptUnknownHealth = false
+			}()
+
+			got, err := buildExtension(context.Background(), EcsCluster{Name: "steadybit-cluster"}, tt.task, true)
+			if err != nil {
+				t.Fatalf("buildExtension() error = %v", err)
+			}
+			if (got != nil) != tt.wantRegistered {
+				t.Errorf("buildExtension() = %v, wantRegistered %v", got, tt.wantRegistered)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package autoregistration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	OutputFormatTable = "table"
+	OutputFormatJson  = "json"
+)
+
+// Discover discovers the extensions of all clusters once and writes them to w. Extensions discovered before a
+// discovery error are written as well, the error is returned afterward.
+func Discover(ctx context.Context, clusters []EcsCluster, w io.Writer, format string) error {
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+	discoveredExtensions, discoveryErr := discoverExtensions(ctx, clusters)
+	return errors.Join(writeExtensions(w, discoveredExtensions, format), discoveryErr)
+}
+
+// Diff compares the discovered extensions with the registrations at the agent and writes the changes a sync would
+// apply to w, without applying them.
+func Diff(ctx context.Context, httpClient *resty.Client, clusters []EcsCluster, w io.Writer, format string) error {
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+	currentRegistrations, err := getCurrentRegistrations(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	discoveredExtensions, discoveryErr := discoverExtensions(ctx, clusters)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	plan := planSync(ctx, &currentRegistrations, &discoveredExtensions, discoveryErr == nil)
+	if format == OutputFormatJson {
+		return errors.Join(writePlanJson(w, plan), discoveryErr)
+	}
+	return errors.Join(writePlanTable(w, plan), discoveryErr)
+}
+
+func validateOutputFormat(format string) error {
+	if format != OutputFormatTable && format != OutputFormatJson {
+		return fmt.Errorf("unsupported output format: %s, use either '%s' or '%s'", format, OutputFormatTable, OutputFormatJson)
+	}
+	return nil
+}
+
+func writeExtensions(w io.Writer, extensions []extensionConfigAO, format string) error {
+	if format == OutputFormatJson {
+		planned := make([]plannedRegistration, 0, len(extensions))
+		for _, extension := range extensions {
+			planned = append(planned, toPlannedRegistration(extension))
+		}
+		extensionsJson, err := json.Marshal(planned)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(extensionsJson))
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "CLUSTER\tTASK FAMILY\tURL\tTYPES")
+	for _, extension := range extensions {
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", extension.Cluster, extension.TaskFamily, extension.Url, strings.Join(extension.Types, ","))
+	}
+	return table.Flush()
+}
+
+func writePlanTable(w io.Writer, plan syncPlan) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "CHANGE\tCLUSTER\tTASK FAMILY\tURL\tDETAILS")
+	for _, registration := range plan.Remove {
+		_, _ = fmt.Fprintf(table, "remove\t%s\t%s\t%s\ttypes: %v\n", registration.Cluster, registration.TaskFamily, registration.Url, registration.Types)
+	}
+	for _, update := range plan.Update {
+		_, _ = fmt.Fprintf(table, "update\t%s\t%s\t%s\t%s\n", update.Desired.Cluster, update.Desired.TaskFamily, update.Desired.Url, describeChanges(update.Current, update.Desired))
+	}
+	for _, registration := range plan.Add {
+		_, _ = fmt.Fprintf(table, "add\t%s\t%s\t%s\ttypes: %v\n", registration.Cluster, registration.TaskFamily, registration.Url, registration.Types)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,117 @@
+package autoregistration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/go-resty/resty/v2"
+	"github.com/jarcoal/httpmock"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/stretchr/testify/mock"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_writeExtensions(t *testing.T) {
+	extensions := []extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", Types: []string{"ACTION", "DISCOVERY"}, Cluster: "steadybit-cluster", TaskFamily: "steadybit-extension-host"},
+	}
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			name:   "Should write table",
+			format: OutputFormatTable,
+			want: "CLUSTER            TASK FAMILY               URL                   TYPES\n" +
+				"steadybit-cluster  steadybit-extension-host  http://10.0.0.1:8080  ACTION,DISCOVERY\n",
+		},
+		{
+			name:   "Should write json",
+			format: OutputFormatJson,
+			want:   `[{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"],"cluster":"steadybit-cluster","taskFamily":"steadybit-extension-host"}]` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			if err := writeExtensions(&output, extensions, tt.format); err != nil {
+				t.Fatalf("writeExtensions() error = %v", err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("writeExtensions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_writePlanTable(t *testing.T) {
+	var output bytes.Buffer
+	err := writePlanTable(&output, syncPlan{
+		Remove: []extensionConfigAO{{Url: "http://10.0.0.4:8080", Types: []string{"ACTION"}}},
+		Update: []registrationUpdate{{
+			Current: extensionConfigAO{Url: "http://10.0.0.2:8080", Types: []string{"ACTION"}},
+			Desired: extensionConfigAO{Url: "http://10.0.0.2:8080", Types: []string{"ACTION", "DISCOVERY"}, Cluster: "c", TaskFamily: "f"},
+		}},
+		Add: []extensionConfigAO{{Url: "http://10.0.0.3:8080", Types: []string{"ACTION"}, Cluster: "c", TaskFamily: "f"}},
+	})
+	if err != nil {
+		t.Fatalf("writePlanTable() error = %v", err)
+	}
+	want := "CHANGE  CLUSTER  TASK FAMILY  URL                   DETAILS\n" +
+		"remove                        http://10.0.0.4:8080  types: [ACTION]\n" +
+		"update  c        f            http://10.0.0.2:8080  types: [ACTION] -> [ACTION DISCOVERY]\n" +
+		"add     c        f            http://10.0.0.3:8080  types: [ACTION]\n"
+	if got := output.String(); got != want {
+		t.Errorf("writePlanTable() = %q, want %q", got, want)
+	}
+}
+
+func Test_Diff_keepsOwnership(t *testing.T) {
+	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
+	config.Config.OwnershipStateFile = filepath.Join(t.TempDir(), "ownership.json")
+	defer func() { config.Config.OwnershipStateFile = "" }()
+	clear(ownedRegistrations)
+	ecsMock := new(ecsClientApiMock)
+	ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(1)}}, nil)
+	ecsMock.On("DescribeTasks", mock.Anything, mock.Anything).Return(&ecs.DescribeTasksOutput{Tasks: []types.Task{replicaTask(1)}}, nil)
+	var ecsClient EcsApi = ecsMock
+	var ec2Client Ec2Api = new(ec2ClientApiMock)
+	clusters := []EcsCluster{{Name: "steadybit-cluster", EcsClient: &ecsClient, Ec2Client: &ec2Client}}
+	client := resty.New()
+	client.SetBaseURL("http://localhost:42899")
+	httpmock.ActivateNonDefault(client.GetClient())
+	defer httpmock.Reset()
+	header := http.Header{}
+	header.Add("Content-Type", "application/json")
+	// the registration of the discovered extension is not owned yet, a sync would adopt it
+	httpmock.RegisterResponder("GET", "http://localhost:42899/extensions",
+		httpmock.NewStringResponder(200, `[{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}]`).HeaderAdd(header))
+
+	var output bytes.Buffer
+	if err := Diff(context.Background(), client, clusters, &output, OutputFormatJson); err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+
+	if len(ownedRegistrations) != 0 {
+		t.Errorf("ownedRegistrations after Diff() = %v, want empty", ownedRegistrations)
+	}
+	if _, err := os.Stat(config.Config.OwnershipStateFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Diff() must not write the ownership state file, stat error = %v", err)
+	}
+}
+
+func Test_validateOutputFormat(t *testing.T) {
+	if err := validateOutputFormat("yaml"); err == nil {
+		t.Errorf("validateOutputFormat() expected error for unsupported format")
+	}
+	if err := validateOutputFormat(OutputFormatJson); err != nil {
+		t.Errorf("validateOutputFormat() error = %v", err)
+	}
+}
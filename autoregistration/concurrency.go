@@ -0,0 +1,25 @@
+package autoregistration
+
+import (
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"sync"
+)
+
+// forEachConcurrently calls fn for every index in [0, n), running up to the configured discovery concurrency calls at
+// once, and waits for all of them. Callers store the results by index, so they are merged in a deterministic order.
+func forEachConcurrently(n int, fn func(i int)) {
+	semaphore := make(chan struct{}, discoveryConcurrency())
+	var wg sync.WaitGroup
+	for i := range n {
+		semaphore <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-semaphore }()
+			fn(i)
+		})
+	}
+	wg.Wait()
+}
+
+func discoveryConcurrency() int {
+	return max(extensionconfig.Config.DiscoveryConcurrency, 1)
+}
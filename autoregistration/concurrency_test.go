@@ -0,0 +1,86 @@
+package autoregistration
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/stretchr/testify/mock"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_forEachConcurrently(t *testing.T) {
+	config.Config.DiscoveryConcurrency = 3
+	defer func() { config.Config.DiscoveryConcurrency = 0 }()
+	var running, maxRunning atomic.Int32
+	results := make([]int, 10)
+
+	forEachConcurrently(len(results), func(i int) {
+		current := running.Add(1)
+		for {
+			previous := maxRunning.Load()
+			if current <= previous || maxRunning.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		// later indexes finish first, the results are still stored in order
+		time.Sleep(time.Duration(len(results)-i) * time.Millisecond)
+		results[i] = i * i
+		running.Add(-1)
+	})
+
+	if got := maxRunning.Load(); got > 3 {
+		t.Errorf("max concurrent calls = %v, want <= 3", got)
+	}
+	if want := []int{0, 1, 4, 9, 16, 25, 36, 49, 64, 81}; !slices.Equal(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+}
+
+func Test_discoverExtensions_concurrently(t *testing.T) {
+	previousTaskFamilies := config.Config.TaskFamilies
+	config.Config.DiscoveryConcurrency = 4
+	config.Config.TaskFamilies = make([]string, 0)
+	tasks := make([]types.Task, 0)
+	for i := range 8 {
+		config.Config.TaskFamilies = append(config.Config.TaskFamilies, fmt.Sprintf("steadybit-extension-%d", i))
+		tasks = append(tasks, replicaTask(i))
+	}
+	defer func() {
+		config.Config.DiscoveryConcurrency = 0
+		config.Config.TaskFamilies = previousTaskFamilies
+	}()
+	newCluster := func(name string) EcsCluster {
+		ecsMock := &describeTasksFake{tasks: tasks}
+		for i, taskFamily := range config.Config.TaskFamilies {
+			ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+				return *input.Family == taskFamily
+			}), mock.Anything).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(i)}}, nil)
+		}
+		var ecsClient EcsApi = ecsMock
+		var ec2Client Ec2Api = new(ec2ClientApiMock)
+		return EcsCluster{Name: name, EcsClient: &ecsClient, Ec2Client: &ec2Client}
+	}
+
+	got, err := discoverExtensions(context.Background(), []EcsCluster{newCluster("cluster-a"), newCluster("cluster-b")})
+	if err != nil {
+		t.Fatalf("discoverExtensions() error = %v", err)
+	}
+	want := make([]string, 0)
+	for _, cluster := range []string{"cluster-a", "cluster-b"} {
+		for i := range 8 {
+			want = append(want, fmt.Sprintf("%s steadybit-extension-%d http://10.0.0.%d:8080", cluster, i, i))
+		}
+	}
+	gotExtensions := make([]string, 0)
+	for _, extension := range got {
+		gotExtensions = append(gotExtensions, fmt.Sprintf("%s %s %s", extension.Cluster, extension.TaskFamily, extension.Url))
+	}
+	if !slices.Equal(gotExtensions, want) {
+		t.Errorf("discoverExtensions() = %v, want %v", gotExtensions, want)
+	}
+}
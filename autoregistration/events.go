@@ -0,0 +1,164 @@
+package autoregistration
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	taskStateChangeDetailType = "ECS Task State Change"
+	receiveWaitTimeSeconds    = 20
+	receiveErrorBackoff       = 5 * time.Second
+)
+
+type SqsApi interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// TaskStateChangeEvent is an ECS Task State Change event as delivered by EventBridge.
+type TaskStateChangeEvent struct {
+	DetailType string                `json:"detail-type"`
+	Detail     TaskStateChangeDetail `json:"detail"`
+}
+
+type TaskStateChangeDetail struct {
+	ClusterArn        string `json:"clusterArn"`
+	TaskArn           string `json:"taskArn"`
+	TaskDefinitionArn string `json:"taskDefinitionArn"`
+	LastStatus        string `json:"lastStatus"`
+	DesiredStatus     string `json:"desiredStatus"`
+}
+
+// ReceiveTaskStateChangeEvents consumes the ECS Task State Change events of the given SQS queue and passes them to the
+// events channel until the context is cancelled.
+func ReceiveTaskStateChangeEvents(ctx context.Context, sqsClient *SqsApi, queueUrl string, events chan<- TaskStateChangeEvent) {
+	for ctx.Err() == nil {
+		if err := receiveTaskStateChangeEvents(ctx, sqsClient, queueUrl, events); err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msgf("Failed to receive task state change events from queue: %s. Retry in %s.", queueUrl, receiveErrorBackoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(receiveErrorBackoff):
+			}
+		}
+	}
+}
+
+// receiveTaskStateChangeEvents receives one batch of messages. Messages are deleted from the queue once they are passed
+// to the events channel. Messages that cannot be parsed are deleted as well, as they would never succeed.
+func receiveTaskStateChangeEvents(ctx context.Context, sqsClient *SqsApi, queueUrl string, events chan<- TaskStateChangeEvent) error {
+	output, err := (*sqsClient).ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            &queueUrl,
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     receiveWaitTimeSeconds,
+	})
+	if err != nil {
+		return err
+	}
+	for _, message := range output.Messages {
+		var event TaskStateChangeEvent
+		if err := json.Unmarshal([]byte(*message.Body), &event); err != nil {
+			log.Warn().Err(err).Msgf("Failed to parse message: %s. Ignore.", *message.MessageId)
+		} else if event.DetailType != taskStateChangeDetailType {
+			log.Debug().Msgf("Message: %s is no task state change event but '%s'. Ignore.", *message.MessageId, event.DetailType)
+		} else {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if _, err := (*sqsClient).DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      &queueUrl,
+			ReceiptHandle: message.ReceiptHandle,
+		}); err != nil {
+			log.Warn().Err(err).Msgf("Failed to delete message: %s.", *message.MessageId)
+		}
+	}
+	return nil
+}
+
+// HandleTaskStateChangeEvent incrementally adds the registration of a task that started running or removes the
+// registration of a task that is stopping. Any inconsistency is corrected by the next full sync.
+func HandleTaskStateChangeEvent(ctx context.Context, httpClient *resty.Client, clusters []EcsCluster, event TaskStateChangeEvent) {
+	detail := event.Detail
+	clusterIndex := slices.IndexFunc(clusters, func(cluster EcsCluster) bool {
+		return cluster.Name == clusterName(detail.ClusterArn)
+	})
+	if clusterIndex < 0 {
+		log.Debug().Msgf("Task: %s - Cluster %s is not configured. Ignore.", detail.TaskArn, detail.ClusterArn)
+		return
+	}
+	if !isTaskFamilySelected(taskFamily(detail.TaskDefinitionArn)) {
+		log.Debug().Msgf("Task: %s - Task family %s is not selected. Ignore.", detail.TaskArn, taskFamily(detail.TaskDefinitionArn))
+		return
+	}
+	starting := detail.LastStatus == "RUNNING" && detail.DesiredStatus == "RUNNING"
+	stopping := detail.DesiredStatus == "STOPPED"
+	if !starting && !stopping {
+		return
+	}
+
+	cluster := clusters[clusterIndex]
+	tasks, err := describeTasks(ctx, cluster, []string{detail.TaskArn})
+	if err != nil {
+		log.Warn().Err(err).Msgf("Task: %s - Failed to describe task. Ignore.", detail.TaskArn)
+		return
+	}
+	if len(tasks) == 0 {
+		log.Warn().Msgf("Task: %s - Task not found. Ignore.", detail.TaskArn)
+		return
+	}
+	if !isTaskSelected(ctx, cluster, tasks[0]) {
+		log.Debug().Msgf("Task: %s - Task is not tagged or its service is not selected. Ignore.", detail.TaskArn)
+		return
+	}
+	extension, err := buildExtension(ctx, cluster, tasks[0], !stopping)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Task: %s - Failed to discover extension. Ignore.", detail.TaskArn)
+		return
+	}
+	if extension == nil {
+		return
+	}
+	extension.TaskFamily = taskFamily(detail.TaskDefinitionArn)
+
+	currentRegistrations, err := getCurrentRegistrations(ctx, httpClient)
+	if err != nil {
+		return
+	}
+	currentRegistration := findRegistration(&currentRegistrations, extension.Url)
+	var plan syncPlan
+	if starting && currentRegistration == nil {
+		if isHealthy(ctx, *extension) {
+			plan.Add = append(plan.Add, *extension)
+		}
+	} else if starting && registrationChanged(*currentRegistration, *extension) && isManaged(extension.Url) {
+		plan.Update = append(plan.Update, registrationUpdate{Current: *currentRegistration, Desired: *extension})
+	} else if stopping && currentRegistration != nil && isManaged(extension.Url) {
+		plan.Remove = append(plan.Remove, *currentRegistration)
+	}
+	if !plan.isEmpty() {
+		_ = applyPlan(ctx, httpClient, plan)
+	}
+}
+
+// clusterName returns the name of a cluster given either its name or its ARN.
+func clusterName(clusterArn string) string {
+	return clusterArn[strings.LastIndex(clusterArn, "/")+1:]
+}
+
+// taskFamily extracts the family from a task definition ARN like `arn:aws:ecs:<region>:<account>:task-definition/<family>:<revision>`.
+func taskFamily(taskDefinitionArn string) string {
+	familyAndRevision := taskDefinitionArn[strings.LastIndex(taskDefinitionArn, "/")+1:]
+	if i := strings.LastIndex(familyAndRevision, ":"); i >= 0 {
+		return familyAndRevision[:i]
+	}
+	return familyAndRevision
+}
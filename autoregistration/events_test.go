@@ -0,0 +1,250 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/go-resty/resty/v2"
+	"github.com/jarcoal/httpmock"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type sqsClientApiMock struct {
+	mock.Mock
+}
+
+func (m *sqsClientApiMock) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
+}
+
+func (m *sqsClientApiMock) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sqs.DeleteMessageOutput), args.Error(1)
+}
+
+func taskStateChangeEvent(lastStatus string, desiredStatus string) TaskStateChangeEvent {
+	return TaskStateChangeEvent{
+		DetailType: "ECS Task State Change",
+		Detail: TaskStateChangeDetail{
+			ClusterArn:        "arn:aws:ecs:eu-central-1:123456789012:cluster/steadybit-cluster",
+			TaskArn:           taskArn(1),
+			TaskDefinitionArn: "arn:aws:ecs:eu-central-1:123456789012:task-definition/steadybit-extension-test:3",
+			LastStatus:        lastStatus,
+			DesiredStatus:     desiredStatus,
+		},
+	}
+}
+
+func Test_receiveTaskStateChangeEvents(t *testing.T) {
+	sqsMock := new(sqsClientApiMock)
+	sqsMock.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{
+		Messages: []sqstypes.Message{
+			{
+				MessageId:     new("1"),
+				ReceiptHandle: new("receipt-1"),
+				Body: new(`{"detail-type":"ECS Task State Change","detail":{"clusterArn":"arn:aws:ecs:eu-central-1:123456789012:cluster/steadybit-cluster",` +
+					`"taskArn":"` + taskArn(1) + `","taskDefinitionArn":"arn:aws:ecs:eu-central-1:123456789012:task-definition/steadybit-extension-test:3",` +
+					`"lastStatus":"RUNNING","desiredStatus":"RUNNING"}}`),
+			},
+			{
+				MessageId:     new("2"),
+				ReceiptHandle: new("receipt-2"),
+				Body:          new(`{"detail-type":"ECS Container Instance State Change","detail":{}}`),
+			},
+			{
+				MessageId:     new("3"),
+				ReceiptHandle: new("receipt-3"),
+				Body:          new(`not json`),
+			},
+		},
+	}, nil)
+	sqsMock.On("DeleteMessage", mock.Anything, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+	var sqsClient SqsApi = sqsMock
+
+	events := make(chan TaskStateChangeEvent, 3)
+	err := receiveTaskStateChangeEvents(context.Background(), &sqsClient, "https://sqs.eu-central-1.amazonaws.com/123456789012/events", events)
+	close(events)
+
+	if err != nil {
+		t.Errorf("receiveTaskStateChangeEvents() error = %v", err)
+	}
+	got := make([]TaskStateChangeEvent, 0)
+	for event := range events {
+		got = append(got, event)
+	}
+	if want := []TaskStateChangeEvent{taskStateChangeEvent("RUNNING", "RUNNING")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("receiveTaskStateChangeEvents() events = %v, want %v", got, want)
+	}
+	sqsMock.AssertNumberOfCalls(t, "DeleteMessage", 3)
+}
+
+func Test_HandleTaskStateChangeEvent(t *testing.T) {
+	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
+	tests := []struct {
+		name                 string
+		event                TaskStateChangeEvent
+		currentRegistrations string
+		ownedRegistrations   []string
+		requireRunning       bool
+		lastStatus           string
+		want                 map[string]int
+	}{
+		{
+			name:                 "Should add registration of started task",
+			event:                taskStateChangeEvent("RUNNING", "RUNNING"),
+			currentRegistrations: `[]`,
+			want: map[string]int{
+				"GET http://localhost:42899/extensions":         1,
+				"POST http://localhost:42899/extensions <mock>": 1,
+			},
+		},
+		{
+			name:                 "Should not add registration of started task twice",
+			event:                taskStateChangeEvent("RUNNING", "RUNNING"),
+			currentRegistrations: `[{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}]`,
+			want: map[string]int{
+				"GET http://localhost:42899/extensions": 1,
+			},
+		},
+		{
+			name:                 "Should update registration of started task with changed types",
+			event:                taskStateChangeEvent("RUNNING", "RUNNING"),
+			currentRegistrations: `[{"url":"http://10.0.0.1:8080","types":["ACTION"]}]`,
+			ownedRegistrations:   []string{"http://10.0.0.1:8080"},
+			want: map[string]int{
+				"GET http://localhost:42899/extensions":          1,
+				"DELETE http://localhost:42899/extensions <old>": 1,
+				"POST http://localhost:42899/extensions <mock>":  1,
+			},
+		},
+		{
+			name:                 "Should remove registration of stopping task",
+			event:                taskStateChangeEvent("RUNNING", "STOPPED"),
+			currentRegistrations: `[{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}]`,
+			ownedRegistrations:   []string{"http://10.0.0.1:8080"},
+			want: map[string]int{
+				"GET http://localhost:42899/extensions":           1,
+				"DELETE http://localhost:42899/extensions <mock>": 1,
+			},
+		},
+		{
+			name:                 "Should remove registration of stopping task as registered",
+			event:                taskStateChangeEvent("RUNNING", "STOPPED"),
+			currentRegistrations: `[{"url":"http://10.0.0.1:8080","types":["ACTION"]}]`,
+			ownedRegistrations:   []string{"http://10.0.0.1:8080"},
+			want: map[string]int{
+				"GET http://localhost:42899/extensions":          1,
+				"DELETE http://localhost:42899/extensions <old>": 1,
+			},
+		},
+		{
+			name:                 "Should remove registration of stopping task if running tasks are required",
+			event:                taskStateChangeEvent("STOPPING", "STOPPED"),
+			currentRegistrations: `[{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}]`,
+			ownedRegistrations:   []string{"http://10.0.0.1:8080"},
+			requireRunning:       true,
+			lastStatus:           "STOPPING",
+			want: map[string]int{
+				"GET http://localhost:42899/extensions":           1,
+				"DELETE http://localhost:42899/extensions <mock>": 1,
+			},
+		},
+		{
+			name:                 "Should not remove registration of stopping task not owned",
+			event:                taskStateChangeEvent("RUNNING", "STOPPED"),
+			currentRegistrations: `[{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}]`,
+			want: map[string]int{
+				"GET http://localhost:42899/extensions": 1,
+			},
+		},
+		{
+			name:  "Should ignore pending task",
+			event: taskStateChangeEvent("PENDING", "RUNNING"),
+			want:  map[string]int{},
+		},
+		{
+			name: "Should ignore task of other family",
+			event: func() TaskStateChangeEvent {
+				event := taskStateChangeEvent("RUNNING", "RUNNING")
+				event.Detail.TaskDefinitionArn = "arn:aws:ecs:eu-central-1:123456789012:task-definition/other:1"
+				return event
+			}(),
+			want: map[string]int{},
+		},
+		{
+			name: "Should ignore task of other cluster",
+			event: func() TaskStateChangeEvent {
+				event := taskStateChangeEvent("RUNNING", "RUNNING")
+				event.Detail.ClusterArn = "arn:aws:ecs:eu-central-1:123456789012:cluster/other"
+				return event
+			}(),
+			want: map[string]int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.RequireRunning = tt.requireRunning
+			defer func() { config.Config.RequireRunning = false }()
+			clear(ownedRegistrations)
+			for _, url := range tt.ownedRegistrations {
+				own(extensionConfigAO{Url: url})
+			}
+			task := replicaTask(1)
+			if tt.lastStatus != "" {
+				task.LastStatus = new(tt.lastStatus)
+			}
+			ecsMock := new(ecsClientApiMock)
+			ecsMock.On("DescribeTasks", mock.Anything, mock.MatchedBy(func(input *ecs.DescribeTasksInput) bool {
+				return reflect.DeepEqual(input.Tasks, []string{taskArn(1)})
+			})).Return(&ecs.DescribeTasksOutput{
+				Tasks: []types.Task{task},
+			}, nil)
+			var ecsClient EcsApi = ecsMock
+			var ec2Client Ec2Api = new(ec2ClientApiMock)
+			clusters := []EcsCluster{{Name: "steadybit-cluster", EcsClient: &ecsClient, Ec2Client: &ec2Client}}
+
+			client := resty.New()
+			client.SetBaseURL("http://localhost:42899")
+			httpmock.ActivateNonDefault(client.GetClient())
+			header := http.Header{}
+			header.Add("Content-Type", "application/json")
+			httpmock.RegisterResponder("GET", "http://localhost:42899/extensions",
+				httpmock.NewStringResponder(200, tt.currentRegistrations).HeaderAdd(header))
+			httpmock.RegisterMatcherResponder("POST", "http://localhost:42899/extensions",
+				httpmock.BodyContainsString(`{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}`).WithName("mock"),
+				httpmock.NewStringResponder(200, ""))
+			httpmock.RegisterMatcherResponder("DELETE", "http://localhost:42899/extensions",
+				httpmock.BodyContainsString(`{"url":"http://10.0.0.1:8080","types":["ACTION","DISCOVERY"]}`).WithName("mock"),
+				httpmock.NewStringResponder(200, ""))
+			httpmock.RegisterMatcherResponder("DELETE", "http://localhost:42899/extensions",
+				httpmock.BodyContainsString(`{"url":"http://10.0.0.1:8080","types":["ACTION"]}`).WithName("old"),
+				httpmock.NewStringResponder(200, ""))
+
+			HandleTaskStateChangeEvent(context.Background(), client, clusters, tt.event)
+
+			got := httpmock.GetCallCountInfo()
+			for key, count := range got {
+				if count == 0 {
+					delete(got, key)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("httpmock.GetCallCountInfo() = %v, want %v", got, tt.want)
+			}
+			httpmock.Reset()
+		})
+	}
+}
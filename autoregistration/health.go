@@ -0,0 +1,109 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/steadybit/extension-kit/exthealth"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckInterval = 5 * time.Second
+)
+
+var (
+	health = newSyncHealth(time.Now())
+)
+
+// syncHealth tracks the outcome of the sync cycles to derive the liveness and readiness of the sidecar.
+type syncHealth struct {
+	mu                    sync.Mutex
+	lastCycle             time.Time
+	lastSuccessfulSync    time.Time
+	agentFailuresInARow   int
+	lastReportedAliveness bool
+	lastReportedReadiness bool
+	reportedAtLeastOnce   bool
+}
+
+func newSyncHealth(now time.Time) *syncHealth {
+	return &syncHealth{lastCycle: now, lastSuccessfulSync: now}
+}
+
+// recordCycle records a finished sync cycle. A sync is successful if the agent was reachable and the discovery complete.
+func (h *syncHealth) recordCycle(now time.Time, agentReachable bool, discoveryComplete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCycle = now
+	if agentReachable {
+		h.agentFailuresInARow = 0
+	} else {
+		h.agentFailuresInARow++
+	}
+	if agentReachable && discoveryComplete {
+		h.lastSuccessfulSync = now
+	}
+}
+
+// isAlive reports whether the sync loop still finishes cycles, regardless of their outcome.
+func (h *syncHealth) isAlive(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return now.Sub(h.lastCycle) <= maxSyncAge()
+}
+
+// isReady reports whether the last successful sync is recent enough and the agent was reachable in the last cycles.
+func (h *syncHealth) isReady(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.lastSuccessfulSync) > maxSyncAge() {
+		return false
+	}
+	return h.agentFailuresInARow < extensionconfig.Config.HealthMaxAgentFailures
+}
+
+func maxSyncAge() time.Duration {
+	return time.Duration(extensionconfig.Config.HealthMaxSyncIntervals*extensionconfig.Config.DiscoveryInterval) * time.Second
+}
+
+// report passes the liveness and readiness to the probes of the extension kit, logging every change.
+func (h *syncHealth) report(now time.Time) {
+	alive := h.isAlive(now)
+	ready := h.isReady(now)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.reportedAtLeastOnce || alive != h.lastReportedAliveness {
+		if !alive {
+			log.Warn().Msgf("No sync cycle finished within %s. Report not alive.", maxSyncAge())
+		}
+		exthealth.SetAlive(alive)
+	}
+	if !h.reportedAtLeastOnce || ready != h.lastReportedReadiness {
+		if !ready {
+			log.Warn().Msgf("No successful sync within %s or agent unreachable for %d cycles. Report not ready.", maxSyncAge(), h.agentFailuresInARow)
+		}
+		exthealth.SetReady(ready)
+	}
+	h.lastReportedAliveness = alive
+	h.lastReportedReadiness = ready
+	h.reportedAtLeastOnce = true
+}
+
+// StartHealthMonitor starts the liveness and readiness probes and keeps them updated with the health of the sync loop.
+// Once the context is cancelled, the sidecar is reported as not ready.
+func StartHealthMonitor(ctx context.Context, port int) {
+	exthealth.StartProbes(port)
+	go func() {
+		for {
+			health.report(time.Now())
+			select {
+			case <-ctx.Done():
+				exthealth.SetReady(false)
+				return
+			case <-time.After(healthCheckInterval):
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package autoregistration
+
+import (
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"testing"
+	"time"
+)
+
+func Test_syncHealth(t *testing.T) {
+	config.Config.DiscoveryInterval = 30
+	config.Config.HealthMaxSyncIntervals = 3
+	config.Config.HealthMaxAgentFailures = 2
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type cycle struct {
+		after             time.Duration
+		agentReachable    bool
+		discoveryComplete bool
+	}
+	tests := []struct {
+		name      string
+		cycles    []cycle
+		at        time.Duration
+		wantAlive bool
+		wantReady bool
+	}{
+		{
+			name:      "Should be alive and ready after startup",
+			at:        30 * time.Second,
+			wantAlive: true,
+			wantReady: true,
+		},
+		{
+			name:      "Should be alive and ready after successful sync",
+			cycles:    []cycle{{after: 80 * time.Second, agentReachable: true, discoveryComplete: true}},
+			at:        120 * time.Second,
+			wantAlive: true,
+			wantReady: true,
+		},
+		{
+			name:      "Should be neither alive nor ready without any cycle",
+			at:        91 * time.Second,
+			wantAlive: false,
+			wantReady: false,
+		},
+		{
+			name: "Should not be ready if last successful sync is too old",
+			cycles: []cycle{
+				{after: 30 * time.Second, agentReachable: true, discoveryComplete: false},
+				{after: 60 * time.Second, agentReachable: true, discoveryComplete: false},
+				{after: 90 * time.Second, agentReachable: true, discoveryComplete: false},
+			},
+			at:        91 * time.Second,
+			wantAlive: true,
+			wantReady: false,
+		},
+		{
+			name: "Should not be ready if agent is unreachable for too many cycles",
+			cycles: []cycle{
+				{after: 30 * time.Second, agentReachable: false},
+				{after: 60 * time.Second, agentReachable: false},
+			},
+			at:        61 * time.Second,
+			wantAlive: true,
+			wantReady: false,
+		},
+		{
+			name: "Should be ready again once agent is reachable",
+			cycles: []cycle{
+				{after: 30 * time.Second, agentReachable: false},
+				{after: 60 * time.Second, agentReachable: false},
+				{after: 90 * time.Second, agentReachable: true, discoveryComplete: true},
+			},
+			at:        91 * time.Second,
+			wantAlive: true,
+			wantReady: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newSyncHealth(start)
+			for _, c := range tt.cycles {
+				h.recordCycle(start.Add(c.after), c.agentReachable, c.discoveryComplete)
+			}
+			if got := h.isAlive(start.Add(tt.at)); got != tt.wantAlive {
+				t.Errorf("isAlive() = %v, want %v", got, tt.wantAlive)
+			}
+			if got := h.isReady(start.Add(tt.at)); got != tt.wantReady {
+				t.Errorf("isReady() = %v, want %v", got, tt.wantReady)
+			}
+		})
+	}
+}
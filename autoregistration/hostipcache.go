@@ -0,0 +1,182 @@
+package autoregistration
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	maxDescribeContainerInstancesBatchSize = 100
+	// maxDescribeInstancesBatchSize is the maximum number of values of the instance-id filter
+	maxDescribeInstancesBatchSize = 200
+)
+
+var (
+	hostIps = newHostIpCache()
+)
+
+// hostIpCache caches the private ip of the EC2 instance behind a container instance. Entries expire after the configured
+// ttl and are evicted once no task of their container instance is discovered anymore. It is safe for concurrent use.
+type hostIpCache struct {
+	mu      sync.Mutex
+	entries map[string]hostIpCacheEntry
+}
+
+type hostIpCacheEntry struct {
+	cluster   string
+	ip        string
+	expiresAt time.Time
+	lastUsed  time.Time
+}
+
+func newHostIpCache() *hostIpCache {
+	return &hostIpCache{entries: make(map[string]hostIpCacheEntry)}
+}
+
+// resolve returns the host ips of the given container instances, by container instance ARN. Missing or expired entries
+// are looked up in batches. Container instances that cannot be found are missing in the result.
+func (c *hostIpCache) resolve(ctx context.Context, cluster EcsCluster, containerInstanceArns []string) (map[string]string, error) {
+	now := time.Now()
+	result := make(map[string]string, len(containerInstanceArns))
+	missing := make([]string, 0)
+	c.mu.Lock()
+	for _, containerInstanceArn := range containerInstanceArns {
+		entry, ok := c.entries[containerInstanceArn]
+		if ok && now.Before(entry.expiresAt) {
+			entry.lastUsed = now
+			c.entries[containerInstanceArn] = entry
+			result[containerInstanceArn] = entry.ip
+		} else if !slices.Contains(missing, containerInstanceArn) {
+			missing = append(missing, containerInstanceArn)
+		}
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	resolved, err := lookupHostIps(ctx, cluster, missing)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := now.Add(time.Duration(extensionconfig.Config.HostIpCacheTtl) * time.Second)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for containerInstanceArn, ip := range resolved {
+		c.entries[containerInstanceArn] = hostIpCacheEntry{cluster: cluster.Name, ip: ip, expiresAt: expiresAt, lastUsed: now}
+		result[containerInstanceArn] = ip
+	}
+	return result, nil
+}
+
+// evictUnused removes all entries of the given cluster that were not used since the given time.
+func (c *hostIpCache) evictUnused(cluster string, since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for containerInstanceArn, entry := range c.entries {
+		if entry.cluster == cluster && entry.lastUsed.Before(since) {
+			log.Debug().Msgf("Evict host ip of container instance: %s", containerInstanceArn)
+			delete(c.entries, containerInstanceArn)
+		}
+	}
+}
+
+// lookupHostIps describes the given container instances and their EC2 instances in batches. The batches are described
+// concurrently.
+func lookupHostIps(ctx context.Context, cluster EcsCluster, containerInstanceArns []string) (map[string]string, error) {
+	containerInstanceBatches := slices.Collect(slices.Chunk(containerInstanceArns, maxDescribeContainerInstancesBatchSize))
+	batchInstanceIds := make([]map[string]string, len(containerInstanceBatches))
+	errs := make([]error, len(containerInstanceBatches))
+	forEachConcurrently(len(containerInstanceBatches), func(i int) {
+		batchInstanceIds[i], errs[i] = describeContainerInstances(ctx, cluster, containerInstanceBatches[i])
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	instanceIds := make(map[string]string)
+	for _, batch := range batchInstanceIds {
+		maps.Copy(instanceIds, batch)
+	}
+
+	instanceBatches := slices.Collect(slices.Chunk(slices.Sorted(maps.Keys(instanceIds)), maxDescribeInstancesBatchSize))
+	batchIps := make([]map[string]string, len(instanceBatches))
+	errs = make([]error, len(instanceBatches))
+	forEachConcurrently(len(instanceBatches), func(i int) {
+		batchIps[i], errs[i] = describeInstanceIps(ctx, cluster, instanceBatches[i], instanceIds)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	ips := make(map[string]string)
+	for _, batch := range batchIps {
+		maps.Copy(ips, batch)
+	}
+	return ips, nil
+}
+
+// describeContainerInstances returns the EC2 instance ids of the given container instances, mapped to the container
+// instance ARN.
+func describeContainerInstances(ctx context.Context, cluster EcsCluster, containerInstanceArns []string) (map[string]string, error) {
+	done := observeApiCall(apiEcs, "DescribeContainerInstances")
+	callCtx, cancel := withAwsTimeout(ctx)
+	output, err := (*cluster.EcsClient).DescribeContainerInstances(callCtx, &ecs.DescribeContainerInstancesInput{
+		Cluster:            &cluster.Name,
+		ContainerInstances: containerInstanceArns,
+	})
+	cancel()
+	done()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to describe container instances.")
+		return nil, err
+	}
+	for _, failure := range output.Failures {
+		log.Warn().Msgf("Failed to describe container instance: %s. Reason: %s", aws.ToString(failure.Arn), aws.ToString(failure.Reason))
+	}
+	instanceIds := make(map[string]string)
+	for _, containerInstance := range output.ContainerInstances {
+		if containerInstance.ContainerInstanceArn != nil && containerInstance.Ec2InstanceId != nil {
+			instanceIds[*containerInstance.Ec2InstanceId] = *containerInstance.ContainerInstanceArn
+		}
+	}
+	return instanceIds, nil
+}
+
+// describeInstanceIps returns the private ips of the given EC2 instances, mapped to the container instance ARN.
+func describeInstanceIps(ctx context.Context, cluster EcsCluster, ec2InstanceIds []string, containerInstanceArns map[string]string) (map[string]string, error) {
+	ips := make(map[string]string)
+	paginator := ec2.NewDescribeInstancesPaginator(*cluster.Ec2Client, &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{{Name: new("instance-id"), Values: ec2InstanceIds}},
+	})
+	for paginator.HasMorePages() {
+		done := observeApiCall(apiEc2, "DescribeInstances")
+		callCtx, cancel := withAwsTimeout(ctx)
+		output, err := paginator.NextPage(callCtx)
+		cancel()
+		done()
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to describe ec2 instances.")
+			return nil, err
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.InstanceId == nil || instance.PrivateIpAddress == nil {
+					continue
+				}
+				if containerInstanceArn, ok := containerInstanceArns[*instance.InstanceId]; ok {
+					ips[containerInstanceArn] = *instance.PrivateIpAddress
+				}
+			}
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,154 @@
+package autoregistration
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/stretchr/testify/mock"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const containerInstanceArnPrefix = "arn:aws:ecs:eu-central-1:123456789012:container-instance/"
+
+func containerInstanceArn(i int) string {
+	return fmt.Sprintf("%s%d", containerInstanceArnPrefix, i)
+}
+
+// containerInstancesFake maps container instance i to ec2 instance i-i with ip 10.0.1.i and records the requests.
+type containerInstancesFake struct {
+	ecsClientApiMock
+	describeContainerInstancesInputs []*ecs.DescribeContainerInstancesInput
+	describeInstancesInputs          []*ec2.DescribeInstancesInput
+}
+
+func (f *containerInstancesFake) DescribeContainerInstances(_ context.Context, input *ecs.DescribeContainerInstancesInput, _ ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error) {
+	f.describeContainerInstancesInputs = append(f.describeContainerInstancesInputs, input)
+	output := &ecs.DescribeContainerInstancesOutput{}
+	for _, arn := range input.ContainerInstances {
+		output.ContainerInstances = append(output.ContainerInstances, types.ContainerInstance{
+			ContainerInstanceArn: new(arn),
+			Ec2InstanceId:        new("i-" + strings.TrimPrefix(arn, containerInstanceArnPrefix)),
+		})
+	}
+	return output, nil
+}
+
+func (f *containerInstancesFake) DescribeInstances(_ context.Context, input *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.describeInstancesInputs = append(f.describeInstancesInputs, input)
+	instances := make([]ec2types.Instance, 0)
+	for _, instanceId := range input.Filters[0].Values {
+		instances = append(instances, ec2types.Instance{
+			InstanceId:       new(instanceId),
+			PrivateIpAddress: new("10.0.1." + strings.TrimPrefix(instanceId, "i-")),
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{{Instances: instances}}}, nil
+}
+
+func hostIpCacheClusterFake() (EcsCluster, *containerInstancesFake) {
+	fake := new(containerInstancesFake)
+	var ecsClient EcsApi = fake
+	var ec2Client Ec2Api = fake
+	return EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient, Ec2Client: &ec2Client}, fake
+}
+
+func Test_hostIpCache_resolve(t *testing.T) {
+	config.Config.HostIpCacheTtl = 300
+	cluster, fake := hostIpCacheClusterFake()
+	cache := newHostIpCache()
+
+	arns := make([]string, 0)
+	for i := 0; i < 150; i++ {
+		arns = append(arns, containerInstanceArn(i))
+	}
+	got, err := cache.resolve(context.Background(), cluster, arns)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if len(got) != 150 || got[containerInstanceArn(42)] != "10.0.1.42" {
+		t.Errorf("resolve() = %v, want 150 host ips", got)
+	}
+	if len(fake.describeContainerInstancesInputs) != 2 || len(fake.describeInstancesInputs) != 1 {
+		t.Errorf("resolve() described %d container instance and %d instance batches, want 2 and 1", len(fake.describeContainerInstancesInputs), len(fake.describeInstancesInputs))
+	}
+
+	got, err = cache.resolve(context.Background(), cluster, []string{containerInstanceArn(1), containerInstanceArn(200)})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if want := map[string]string{containerInstanceArn(1): "10.0.1.1", containerInstanceArn(200): "10.0.1.200"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolve() = %v, want %v", got, want)
+	}
+	if last := fake.describeContainerInstancesInputs[len(fake.describeContainerInstancesInputs)-1]; len(fake.describeContainerInstancesInputs) != 3 || !reflect.DeepEqual(last.ContainerInstances, []string{containerInstanceArn(200)}) {
+		t.Errorf("DescribeContainerInstances() container instances = %v, want only the uncached one", last.ContainerInstances)
+	}
+}
+
+func Test_hostIpCache_expiry(t *testing.T) {
+	config.Config.HostIpCacheTtl = 300
+	cluster, fake := hostIpCacheClusterFake()
+	cache := newHostIpCache()
+
+	if _, err := cache.resolve(context.Background(), cluster, []string{containerInstanceArn(1)}); err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	entry := cache.entries[containerInstanceArn(1)]
+	entry.expiresAt = time.Now().Add(-time.Second)
+	cache.entries[containerInstanceArn(1)] = entry
+
+	if _, err := cache.resolve(context.Background(), cluster, []string{containerInstanceArn(1)}); err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if len(fake.describeContainerInstancesInputs) != 2 {
+		t.Errorf("resolve() described %d container instance batches, want 2", len(fake.describeContainerInstancesInputs))
+	}
+}
+
+func Test_hostIpCache_evictUnused(t *testing.T) {
+	config.Config.HostIpCacheTtl = 300
+	cluster, _ := hostIpCacheClusterFake()
+	cache := newHostIpCache()
+
+	if _, err := cache.resolve(context.Background(), cluster, []string{containerInstanceArn(1), containerInstanceArn(2)}); err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	cache.entries[containerInstanceArnPrefix+"other"] = hostIpCacheEntry{cluster: "other-cluster", ip: "10.0.2.1"}
+	cycleStart := time.Now()
+	if _, err := cache.resolve(context.Background(), cluster, []string{containerInstanceArn(1)}); err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	cache.evictUnused(cluster.Name, cycleStart)
+
+	got := make([]string, 0)
+	for arn := range cache.entries {
+		got = append(got, arn)
+	}
+	if len(got) != 2 || cache.entries[containerInstanceArn(2)] != (hostIpCacheEntry{}) {
+		t.Errorf("evictUnused() left %v, want container instance 1 and the entry of the other cluster", got)
+	}
+}
+
+func Test_describeContainerInstances_failureWithoutReason(t *testing.T) {
+	ecsMock := new(ecsClientApiMock)
+	ecsMock.On("DescribeContainerInstances", mock.Anything, mock.Anything).Return(&ecs.DescribeContainerInstancesOutput{
+		ContainerInstances: []types.ContainerInstance{{ContainerInstanceArn: new(containerInstanceArn(1)), Ec2InstanceId: new("i-1")}},
+		Failures:           []types.Failure{{Arn: new(containerInstanceArn(2))}},
+	}, nil)
+	var ecsClient EcsApi = ecsMock
+	cluster := EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient}
+
+	got, err := describeContainerInstances(context.Background(), cluster, []string{containerInstanceArn(1), containerInstanceArn(2)})
+	if err != nil {
+		t.Fatalf("describeContainerInstances() error = %v", err)
+	}
+	if want := map[string]string{"i-1": containerInstanceArn(1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("describeContainerInstances() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"sync"
+	"time"
+)
+
+const (
+	tagPort      = "steadybit_extension_port"
+	tagTypes     = "steadybit_extension_type"
+	tagDaemon    = "steadybit_extension_daemon"
+	tagContainer = "steadybit_extension_container"
+	tagScheme    = "steadybit_extension_scheme"
+	labelPort    = "steadybit.extension.port"
+	labelTypes   = "steadybit.extension.types"
+	labelDaemon  = "steadybit.extension.daemon"
+	labelScheme  = "steadybit.extension.scheme"
+)
+
+var (
+	taskDefinitions = newTaskDefinitionCache()
+)
+
+// taskMetadata describes the extension of a task. It is read from the task tags and from the docker labels of the
+// container definitions.
+type taskMetadata struct {
+	port  *string
+	types *string
+	// daemon is "true" for extensions that run once per container instance and are reached via the host ip
+	daemon *string
+	// container is the name of the extension container, either tagged or the container carrying the labels
+	container *string
+	// scheme is either "http" or "https", the configured default is used if it is missing
+	scheme *string
+}
+
+func (m taskMetadata) isDaemon() bool {
+	return m.daemon != nil && *m.daemon == "true"
+}
+
+// or returns the metadata, taking every missing value from the fallback.
+func (m taskMetadata) or(fallback taskMetadata) taskMetadata {
+	return taskMetadata{
+		port:      firstNonNil(m.port, fallback.port),
+		types:     firstNonNil(m.types, fallback.types),
+		daemon:    firstNonNil(m.daemon, fallback.daemon),
+		container: firstNonNil(m.container, fallback.container),
+		scheme:    firstNonNil(m.scheme, fallback.scheme),
+	}
+}
+
+func firstNonNil(values ...*string) *string {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+func tagMetadata(task types.Task) taskMetadata {
+	return taskMetadata{
+		port:      getTagValue(task.Tags, tagPort),
+		types:     getTagValue(task.Tags, tagTypes),
+		daemon:    getTagValue(task.Tags, tagDaemon),
+		container: getTagValue(task.Tags, tagContainer),
+		scheme:    getTagValue(task.Tags, tagScheme),
+	}
+}
+
+// labelMetadata reads the metadata from the first container definition labelled with the port or types.
+func labelMetadata(containerDefinitions []types.ContainerDefinition) taskMetadata {
+	for _, containerDefinition := range containerDefinitions {
+		port, hasPort := containerDefinition.DockerLabels[labelPort]
+		extensionTypes, hasTypes := containerDefinition.DockerLabels[labelTypes]
+		if !hasPort && !hasTypes {
+			continue
+		}
+		metadata := taskMetadata{container: containerDefinition.Name}
+		if hasPort {
+			metadata.port = &port
+		}
+		if hasTypes {
+			metadata.types = &extensionTypes
+		}
+		if daemon, ok := containerDefinition.DockerLabels[labelDaemon]; ok {
+			metadata.daemon = &daemon
+		}
+		if scheme, ok := containerDefinition.DockerLabels[labelScheme]; ok {
+			metadata.scheme = &scheme
+		}
+		return metadata
+	}
+	return taskMetadata{}
+}
+
+// getTaskMetadata merges the metadata of the task tags and container labels according to the configured precedence.
+// The task definition is only described if labels take precedence or if the tags lack the port or types.
+func getTaskMetadata(ctx context.Context, cluster EcsCluster, task types.Task) (taskMetadata, error) {
+	fromTags := tagMetadata(task)
+	labelsFirst := extensionconfig.Config.MetadataPrecedence == extensionconfig.MetadataPrecedenceLabels
+	if task.TaskDefinitionArn == nil || (!labelsFirst && fromTags.port != nil && fromTags.types != nil) {
+		return fromTags, nil
+	}
+	containerDefinitions, err := taskDefinitions.get(ctx, cluster, *task.TaskDefinitionArn)
+	if err != nil {
+		return fromTags, err
+	}
+	fromLabels := labelMetadata(containerDefinitions)
+	if labelsFirst {
+		return fromLabels.or(fromTags), nil
+	}
+	return fromTags.or(fromLabels), nil
+}
+
+// taskDefinitionCache caches the container definitions per task definition revision. Revisions are immutable, so
+// entries are only evicted once they are not used anymore. It is safe for concurrent use.
+type taskDefinitionCache struct {
+	mu      sync.Mutex
+	entries map[string]taskDefinitionCacheEntry
+}
+
+type taskDefinitionCacheEntry struct {
+	containerDefinitions []types.ContainerDefinition
+	lastUsed             time.Time
+}
+
+func newTaskDefinitionCache() *taskDefinitionCache {
+	return &taskDefinitionCache{entries: make(map[string]taskDefinitionCacheEntry)}
+}
+
+func (c *taskDefinitionCache) get(ctx context.Context, cluster EcsCluster, taskDefinitionArn string) ([]types.ContainerDefinition, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[taskDefinitionArn]
+	if ok {
+		entry.lastUsed = now
+		c.entries[taskDefinitionArn] = entry
+	}
+	c.mu.Unlock()
+	if ok {
+		return entry.containerDefinitions, nil
+	}
+
+	done := observeApiCall(apiEcs, "DescribeTaskDefinition")
+	callCtx, cancel := withAwsTimeout(ctx)
+	output, err := (*cluster.EcsClient).DescribeTaskDefinition(callCtx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefinitionArn,
+	})
+	cancel()
+	done()
+	if err != nil {
+		return nil, err
+	}
+	var containerDefinitions []types.ContainerDefinition
+	if output.TaskDefinition != nil {
+		containerDefinitions = output.TaskDefinition.ContainerDefinitions
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[taskDefinitionArn] = taskDefinitionCacheEntry{containerDefinitions: containerDefinitions, lastUsed: now}
+	return containerDefinitions, nil
+}
+
+// evictUnused removes all task definitions that were not used since the given time.
+func (c *taskDefinitionCache) evictUnused(since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for taskDefinitionArn, entry := range c.entries {
+		if entry.lastUsed.Before(since) {
+			delete(c.entries, taskDefinitionArn)
+		}
+	}
+}
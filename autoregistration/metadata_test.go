@@ -0,0 +1,89 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/stretchr/testify/mock"
+	"reflect"
+	"testing"
+)
+
+func Test_getTaskMetadata(t *testing.T) {
+	taskDefinition := &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &types.TaskDefinition{
+		ContainerDefinitions: []types.ContainerDefinition{
+			{
+				Name: new("extension"),
+				DockerLabels: map[string]string{
+					"steadybit.extension.port":   "8081",
+					"steadybit.extension.types":  "ACTION",
+					"steadybit.extension.daemon": "true",
+				},
+			},
+		},
+	}}
+	withTags := func(tags ...types.Tag) types.Task {
+		task := replicaTask(1)
+		task.TaskDefinitionArn = new("arn:aws:ecs:eu-central-1:123456789012:task-definition/steadybit-extension-test:1")
+		task.Tags = tags
+		return task
+	}
+	portTag := types.Tag{Key: new("steadybit_extension_port"), Value: new("8080")}
+	typesTag := types.Tag{Key: new("steadybit_extension_type"), Value: new("ACTION:DISCOVERY")}
+	tests := []struct {
+		name                       string
+		precedence                 string
+		task                       types.Task
+		want                       taskMetadata
+		wantDescribeTaskDefinition bool
+	}{
+		{
+			name:       "Should use tags without describing the task definition",
+			precedence: config.MetadataPrecedenceTags,
+			task:       withTags(portTag, typesTag),
+			want:       taskMetadata{port: new("8080"), types: new("ACTION:DISCOVERY")},
+		},
+		{
+			name:                       "Should fall back to labels if tags are missing",
+			precedence:                 config.MetadataPrecedenceTags,
+			task:                       withTags(portTag),
+			want:                       taskMetadata{port: new("8080"), types: new("ACTION"), daemon: new("true"), container: new("extension")},
+			wantDescribeTaskDefinition: true,
+		},
+		{
+			name:                       "Should prefer labels",
+			precedence:                 config.MetadataPrecedenceLabels,
+			task:                       withTags(portTag, typesTag),
+			want:                       taskMetadata{port: new("8081"), types: new("ACTION"), daemon: new("true"), container: new("extension")},
+			wantDescribeTaskDefinition: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.MetadataPrecedence = tt.precedence
+			defer func() { config.Config.MetadataPrecedence = config.MetadataPrecedenceTags }()
+			clear(taskDefinitions.entries)
+			ecsMock := new(ecsClientApiMock)
+			ecsMock.On("DescribeTaskDefinition", mock.Anything, mock.Anything).Return(taskDefinition, nil)
+			var ecsClient EcsApi = ecsMock
+			cluster := EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient}
+
+			// The task definition is described once and served from the cache afterwards
+			for range 2 {
+				got, err := getTaskMetadata(context.Background(), cluster, tt.task)
+				if err != nil {
+					t.Fatalf("getTaskMetadata() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("getTaskMetadata() = %+v, want %+v", got, tt.want)
+				}
+			}
+			wantCalls := 0
+			if tt.wantDescribeTaskDefinition {
+				wantCalls = 1
+			}
+			ecsMock.AssertNumberOfCalls(t, "DescribeTaskDefinition", wantCalls)
+		})
+	}
+}
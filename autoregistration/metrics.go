@@ -0,0 +1,206 @@
+package autoregistration
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	metricsNamespace              = "steadybit_auto_registration"
+	unknownTaskFamily             = "unknown"
+	skipReasonNoPort              = "missing_port_tag"
+	skipReasonNoTypes             = "missing_type_tag"
+	skipReasonNoIp                = "missing_ip"
+	skipReasonMisconfiguredDaemon = "misconfigured_daemon"
+	skipReasonInvalidScheme       = "invalid_scheme"
+	skipReasonNotRunning          = "not_running"
+	skipReasonUnhealthy           = "unhealthy"
+	operationAdd                  = "add"
+	operationRemove               = "remove"
+	apiEcs                        = "ecs"
+	apiEc2                        = "ec2"
+	apiAgent                      = "agent"
+	apiExtension                  = "extension"
+	probeResultSuccess            = "success"
+	probeResultFailure            = "failure"
+)
+
+var (
+	registrationsAdded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_added_total",
+		Help:      "The number of extension registrations added at the agent.",
+	})
+	registrationsRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_removed_total",
+		Help:      "The number of extension registrations removed from the agent.",
+	})
+	registrationsUpdated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_updated_total",
+		Help:      "The number of extension registrations replaced at the agent because they changed.",
+	})
+	registrationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registrations_failed_total",
+		Help:      "The number of failed attempts to add or remove an extension registration.",
+	}, []string{"operation"})
+	discoveredExtensionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovered_extensions",
+		Help:      "The number of extensions discovered in the last sync per cluster and task family.",
+	}, []string{"cluster", "task_family"})
+	discoveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_failures_total",
+		Help:      "The number of failed discoveries per cluster and task family. In tag mode, the task family is 'unknown'.",
+	}, []string{"cluster", "task_family"})
+	registeredExtensionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "registered_extensions",
+		Help:      "The number of extensions registered at the agent at the beginning of the last sync per task family. Registrations that were not discovered are counted as task family 'unknown'.",
+	}, []string{"task_family"})
+	tasksSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_skipped_total",
+		Help:      "The number of discovered tasks that were skipped, e.g. because of missing tags or ip.",
+	}, []string{"reason"})
+	extensionProbes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "extension_probes_total",
+		Help:      "The number of health probes of discovered extensions, by result.",
+	}, []string{"result"})
+	agentRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_retries_total",
+		Help:      "The number of retried calls to the agent api.",
+	})
+	agentErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_errors_total",
+		Help:      "The number of failed calls to the agent api, by response status.",
+	}, []string{"status"})
+	awsThrottledCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "aws_throttled_calls_total",
+		Help:      "The number of AWS api calls that were throttled, including retries.",
+	}, []string{"api", "operation"})
+	awsCallBudgetExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "aws_call_budget_exhausted_total",
+		Help:      "The number of syncs that exceeded the AWS api call budget.",
+	})
+	awsCallsPerSync = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "aws_calls_last_sync",
+		Help:      "The number of AWS api calls of the last sync, including retries.",
+	})
+	apiCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_call_duration_seconds",
+		Help:      "The latency of calls to the ECS, EC2 and agent apis and of extension probes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "operation"})
+)
+
+var (
+	// taggedTaskFamilies are the task families discovered per cluster by the previous discovery in tag mode
+	taggedTaskFamilies      = make(map[string]map[string]bool)
+	taggedTaskFamiliesMutex sync.Mutex
+	// registeredTaskFamilies are the task families the registered extensions were last recorded for
+	registeredTaskFamilies = make(map[string]bool)
+)
+
+// observeApiCall starts measuring the latency of an api call. The returned function needs to be called when the call is done.
+func observeApiCall(api string, operation string) func() {
+	start := time.Now()
+	return func() {
+		apiCallDuration.WithLabelValues(api, operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// recordDiscoveredExtensions sets the discovered extensions per task family of the given cluster.
+func recordDiscoveredExtensions(cluster string, taskFamily string, count int) {
+	discoveredExtensionsGauge.WithLabelValues(cluster, taskFamily).Set(float64(count))
+}
+
+// recordTaggedExtensions sets the discovered extensions per task family of the given cluster in tag mode. Task
+// families that were discovered in the previous cycle but not anymore are set to 0.
+func recordTaggedExtensions(cluster string, extensions []extensionConfigAO) {
+	counts := make(map[string]int)
+	for _, extension := range extensions {
+		counts[extension.TaskFamily]++
+	}
+	taggedTaskFamiliesMutex.Lock()
+	defer taggedTaskFamiliesMutex.Unlock()
+	for taskFamily := range taggedTaskFamilies[cluster] {
+		if _, discovered := counts[taskFamily]; !discovered {
+			recordDiscoveredExtensions(cluster, taskFamily, 0)
+		}
+	}
+	taskFamilies := make(map[string]bool, len(counts))
+	for taskFamily, count := range counts {
+		recordDiscoveredExtensions(cluster, taskFamily, count)
+		taskFamilies[taskFamily] = true
+	}
+	taggedTaskFamilies[cluster] = taskFamilies
+}
+
+// recordRegisteredExtensions sets the registered extensions per task family, taking the task family of the discovered
+// extension with the same url. Every configured task family, or in tag mode every discovered one, is reported, task
+// families that are not reported anymore are removed.
+func recordRegisteredExtensions(currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO) {
+	counts := make(map[string]int)
+	if extensionconfig.Config.DiscoveryMode == extensionconfig.DiscoveryModeTags {
+		for _, discoveredExtension := range *discoveredExtensions {
+			counts[discoveredExtension.TaskFamily] = 0
+		}
+	} else {
+		for _, taskFamily := range extensionconfig.Config.TaskFamilies {
+			counts[taskFamily] = 0
+		}
+	}
+	counts[unknownTaskFamily] = 0
+	for _, currentRegistration := range *currentRegistrations {
+		taskFamily := unknownTaskFamily
+		for _, discoveredExtension := range *discoveredExtensions {
+			if discoveredExtension.Url == currentRegistration.Url {
+				taskFamily = discoveredExtension.TaskFamily
+				break
+			}
+		}
+		counts[taskFamily]++
+	}
+	for taskFamily := range registeredTaskFamilies {
+		if _, reported := counts[taskFamily]; !reported {
+			registeredExtensionsGauge.DeleteLabelValues(taskFamily)
+			delete(registeredTaskFamilies, taskFamily)
+		}
+	}
+	for taskFamily, count := range counts {
+		registeredExtensionsGauge.WithLabelValues(taskFamily).Set(float64(count))
+		registeredTaskFamilies[taskFamily] = true
+	}
+}
+
+// StartMetricsServer serves the prometheus metrics at /metrics on the given port.
+func StartMetricsServer(port int) {
+	serverMux := http.NewServeMux()
+	serverMux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: serverMux}
+	go func() {
+		log.Info().Msgf("Starting metrics server on port %d", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msgf("Failed to start metrics server")
+		}
+	}()
+}
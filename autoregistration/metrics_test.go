@@ -0,0 +1,80 @@
+package autoregistration
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"testing"
+)
+
+func Test_recordRegisteredExtensions(t *testing.T) {
+	config.Config.TaskFamilies = []string{"steadybit-extension-test", "steadybit-extension-other"}
+	currentRegistrations := []extensionConfigAO{
+		{Url: "http://10.0.0.1:8080"},
+		{Url: "http://10.0.0.2:8080"},
+		{Url: "http://99.99.99.99:9999"},
+	}
+	discoveredExtensions := []extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", TaskFamily: "steadybit-extension-test"},
+		{Url: "http://10.0.0.2:8080", TaskFamily: "steadybit-extension-test"},
+	}
+
+	recordRegisteredExtensions(&currentRegistrations, &discoveredExtensions)
+
+	want := map[string]float64{
+		"steadybit-extension-test":  2,
+		"steadybit-extension-other": 0,
+		"unknown":                   1,
+	}
+	for taskFamily, count := range want {
+		if got := testutil.ToFloat64(registeredExtensionsGauge.WithLabelValues(taskFamily)); got != count {
+			t.Errorf("registered_extensions{task_family=%q} = %v, want %v", taskFamily, got, count)
+		}
+	}
+}
+
+func Test_recordRegisteredExtensions_tagMode(t *testing.T) {
+	config.Config.DiscoveryMode = config.DiscoveryModeTags
+	config.Config.TaskFamilies = []string{"steadybit-extension-test"}
+	defer func() {
+		config.Config.DiscoveryMode = ""
+	}()
+	currentRegistrations := []extensionConfigAO{{Url: "http://10.0.0.1:8080"}}
+
+	recordRegisteredExtensions(&currentRegistrations, &[]extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", TaskFamily: "steadybit-extension-tagged"},
+		{Url: "http://10.0.0.2:8080", TaskFamily: "steadybit-extension-gone"},
+	})
+	recordRegisteredExtensions(&currentRegistrations, &[]extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", TaskFamily: "steadybit-extension-tagged"},
+	})
+
+	if got := testutil.ToFloat64(registeredExtensionsGauge.WithLabelValues("steadybit-extension-tagged")); got != 1 {
+		t.Errorf("registered_extensions{task_family=\"steadybit-extension-tagged\"} = %v, want 1", got)
+	}
+	for _, taskFamily := range []string{"steadybit-extension-gone", "steadybit-extension-test"} {
+		if registeredExtensionsGauge.DeleteLabelValues(taskFamily) {
+			t.Errorf("registered_extensions{task_family=%q} is reported, want it removed", taskFamily)
+		}
+	}
+}
+
+func Test_recordTaggedExtensions(t *testing.T) {
+	recordTaggedExtensions("steadybit-cluster-tagged", []extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", TaskFamily: "steadybit-extension-test"},
+		{Url: "http://10.0.0.2:8080", TaskFamily: "steadybit-extension-gone"},
+	})
+	recordTaggedExtensions("steadybit-cluster-tagged", []extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", TaskFamily: "steadybit-extension-test"},
+		{Url: "http://10.0.0.3:8080", TaskFamily: "steadybit-extension-test"},
+	})
+
+	want := map[string]float64{
+		"steadybit-extension-test": 2,
+		"steadybit-extension-gone": 0,
+	}
+	for taskFamily, count := range want {
+		if got := testutil.ToFloat64(discoveredExtensionsGauge.WithLabelValues("steadybit-cluster-tagged", taskFamily)); got != count {
+			t.Errorf("discovered_extensions{task_family=%q} = %v, want %v", taskFamily, got, count)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package autoregistration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	// ownedRegistrations are the registrations managed by this sidecar, by url. Besides the registrations added by this
+	// process, it adopts the registrations of discovered extensions. The set is persisted in the configured state file,
+	// so registrations of extensions that stopped while the sidecar was down are still removed after a restart.
+	ownedRegistrations = make(map[string]extensionConfigAO)
+)
+
+func own(registration extensionConfigAO) {
+	if current, owned := ownedRegistrations[registration.Url]; owned && !registrationChanged(current, registration) {
+		return
+	}
+	ownedRegistrations[registration.Url] = registration
+	saveOwnedRegistrations()
+}
+
+func disown(url string) {
+	if _, owned := ownedRegistrations[url]; !owned {
+		return
+	}
+	delete(ownedRegistrations, url)
+	saveOwnedRegistrations()
+}
+
+// LoadOwnedRegistrations restores the owned registrations from the configured state file, if it exists.
+func LoadOwnedRegistrations() {
+	stateFile := extensionconfig.Config.OwnershipStateFile
+	if stateFile == "" {
+		return
+	}
+	state, err := os.ReadFile(stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Debug().Msgf("No ownership state file: %s. Start without owned registrations.", stateFile)
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to read ownership state file: %s. Start without owned registrations.", stateFile)
+		return
+	}
+	var registrations []extensionConfigAO
+	if err := json.Unmarshal(state, &registrations); err != nil {
+		log.Warn().Err(err).Msgf("Failed to parse ownership state file: %s. Start without owned registrations.", stateFile)
+		return
+	}
+	for _, registration := range registrations {
+		ownedRegistrations[registration.Url] = registration
+	}
+	log.Info().Int("count", len(registrations)).Msgf("Restored owned extension registrations from %s.", stateFile)
+}
+
+// saveOwnedRegistrations writes the owned registrations to the configured state file. The file is replaced atomically,
+// so a crash while writing does not lose the previous state.
+func saveOwnedRegistrations() {
+	stateFile := extensionconfig.Config.OwnershipStateFile
+	if stateFile == "" {
+		return
+	}
+	registrations := slices.SortedFunc(maps.Values(ownedRegistrations), func(a, b extensionConfigAO) int {
+		return strings.Compare(a.Url, b.Url)
+	})
+	state, err := json.Marshal(registrations)
+	if err == nil {
+		err = os.WriteFile(stateFile+".tmp", state, 0600)
+	}
+	if err == nil {
+		err = os.Rename(stateFile+".tmp", stateFile)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to write ownership state file: %s. Ownership is lost on restart.", stateFile)
+	}
+}
+
+// isManaged reports whether the sidecar may remove the registration with the given url.
+func isManaged(url string) bool {
+	if extensionconfig.Config.ManageAllRegistrations {
+		return true
+	}
+	_, owned := ownedRegistrations[url]
+	return owned
+}
+
+// adoptableRegistrations returns the discovered extensions whose current registration is not owned yet. The sidecar
+// takes ownership of them when the sync plan is applied.
+func adoptableRegistrations(currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO) []extensionConfigAO {
+	var adoptable []extensionConfigAO
+	for _, discoveredExtension := range *discoveredExtensions {
+		if _, owned := ownedRegistrations[discoveredExtension.Url]; !owned && containsUrl(currentRegistrations, discoveredExtension.Url) {
+			adoptable = append(adoptable, discoveredExtension)
+		}
+	}
+	return adoptable
+}
+
+// adoptRegistrations takes ownership of the given registrations.
+func adoptRegistrations(registrations []extensionConfigAO) {
+	for _, registration := range registrations {
+		log.Debug().Msgf("Adopt existing registration of extension: %s (cluster: %s)", registration.Url, registration.Cluster)
+		own(registration)
+	}
+}
+
+// RemoveOwnedRegistrations removes all registrations owned by this sidecar, e.g. when the agent task is stopping.
+func RemoveOwnedRegistrations(ctx context.Context, httpClient *resty.Client) {
+	log.Info().Int("count", len(ownedRegistrations)).Msg("Remove owned extension registrations.")
+	_ = applyPlan(ctx, httpClient, syncPlan{Remove: slices.Collect(maps.Values(ownedRegistrations))})
+}
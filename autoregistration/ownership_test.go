@@ -0,0 +1,101 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/go-resty/resty/v2"
+	"github.com/jarcoal/httpmock"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_adoptableRegistrations(t *testing.T) {
+	clear(ownedRegistrations)
+
+	got := adoptableRegistrations(&[]extensionConfigAO{
+		{Url: "http://10.0.0.1:8080"},
+		{Url: "http://99.99.99.99:9999"},
+	}, &[]extensionConfigAO{
+		{Url: "http://10.0.0.1:8080", Cluster: "steadybit-cluster"},
+		{Url: "http://10.0.0.2:8080", Cluster: "steadybit-cluster"},
+	})
+
+	want := []extensionConfigAO{{Url: "http://10.0.0.1:8080", Cluster: "steadybit-cluster"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("adoptableRegistrations() = %v, want %v", got, want)
+	}
+	if len(ownedRegistrations) != 0 {
+		t.Errorf("ownedRegistrations = %v, want empty", ownedRegistrations)
+	}
+}
+
+func Test_RemoveOwnedRegistrations(t *testing.T) {
+	client := resty.New()
+	client.SetBaseURL("http://localhost:42899")
+	httpmock.ActivateNonDefault(client.GetClient())
+	defer httpmock.Reset()
+	httpmock.RegisterResponder("POST", "http://localhost:42899/extensions", httpmock.NewStringResponder(200, ""))
+	httpmock.RegisterMatcherResponder("DELETE", "http://localhost:42899/extensions",
+		httpmock.BodyContainsString(`{"url":"http://111.222.333.444:8080","types":["ACTION","DISCOVERY"]}`).WithName("mock"),
+		httpmock.NewStringResponder(200, ""))
+	clear(ownedRegistrations)
+
+	// the manually registered extension is not owned and must neither be removed by the sync nor on shutdown
+	syncRegistrations(context.Background(), client, &[]extensionConfigAO{
+		{
+			Url:   "http://99.99.99.99:9999",
+			Types: []string{"ACTION", "DISCOVERY"},
+		},
+	}, &[]extensionConfigAO{
+		{
+			Url:   "http://111.222.333.444:8080",
+			Types: []string{"ACTION", "DISCOVERY"},
+		},
+	}, true)
+	RemoveOwnedRegistrations(context.Background(), client)
+
+	want := map[string]int{
+		"POST http://localhost:42899/extensions":          1,
+		"DELETE http://localhost:42899/extensions <mock>": 1,
+	}
+	if got := httpmock.GetCallCountInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("httpmock.GetCallCountInfo() = %v, want %v", got, want)
+	}
+	if len(ownedRegistrations) != 0 {
+		t.Errorf("ownedRegistrations = %v, want empty", ownedRegistrations)
+	}
+}
+
+func Test_removeStaleRegistrationAfterRestart(t *testing.T) {
+	config.Config.OwnershipStateFile = filepath.Join(t.TempDir(), "ownership.json")
+	defer func() { config.Config.OwnershipStateFile = "" }()
+	client := resty.New()
+	client.SetBaseURL("http://localhost:42899")
+	httpmock.ActivateNonDefault(client.GetClient())
+	defer httpmock.Reset()
+	httpmock.RegisterResponder("POST", "http://localhost:42899/extensions", httpmock.NewStringResponder(200, ""))
+	httpmock.RegisterMatcherResponder("DELETE", "http://localhost:42899/extensions",
+		httpmock.BodyContainsString(`{"url":"http://10.0.0.1:8080","types":["ACTION"]}`).WithName("stale"),
+		httpmock.NewStringResponder(200, ""))
+	clear(ownedRegistrations)
+	extension := extensionConfigAO{Url: "http://10.0.0.1:8080", Types: []string{"ACTION"}}
+	syncRegistrations(context.Background(), client, &[]extensionConfigAO{}, &[]extensionConfigAO{extension}, true)
+
+	// the sidecar restarts, meanwhile the extension task stopped and is no longer discovered
+	clear(ownedRegistrations)
+	LoadOwnedRegistrations()
+	syncRegistrations(context.Background(), client, &[]extensionConfigAO{extension}, &[]extensionConfigAO{}, true)
+
+	want := map[string]int{
+		"POST http://localhost:42899/extensions":           1,
+		"DELETE http://localhost:42899/extensions <stale>": 1,
+	}
+	if got := httpmock.GetCallCountInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("httpmock.GetCallCountInfo() = %v, want %v", got, want)
+	}
+	LoadOwnedRegistrations()
+	if len(ownedRegistrations) != 0 {
+		t.Errorf("ownedRegistrations after removal = %v, want empty", ownedRegistrations)
+	}
+}
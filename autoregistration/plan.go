@@ -0,0 +1,186 @@
+package autoregistration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"io"
+	"os"
+)
+
+var (
+	// planOutput receives the JSON sync plans in dry-run mode
+	planOutput io.Writer = os.Stdout
+)
+
+// syncPlan lists the registrations a sync removes, updates and adds at the agent, and the state it changes in the
+// sidecar once it is applied.
+type syncPlan struct {
+	Remove []extensionConfigAO
+	Update []registrationUpdate
+	Add    []extensionConfigAO
+	// Adopt are the current registrations of discovered extensions the sidecar takes ownership of
+	Adopt []extensionConfigAO
+	// probeFailures are the consecutive failed probes per extension url, nil if probes are disabled
+	probeFailures map[string]int
+}
+
+type registrationUpdate struct {
+	Current extensionConfigAO
+	Desired extensionConfigAO
+}
+
+func (p syncPlan) isEmpty() bool {
+	return len(p.Remove) == 0 && len(p.Update) == 0 && len(p.Add) == 0
+}
+
+// planSync compares the current registrations with the discovered extensions. Registrations are only planned for
+// removal if the discovery was complete and the registration is managed by the sidecar. Planning has no side effects,
+// neither the ownership nor the probe failures change until the plan is applied.
+func planSync(ctx context.Context, currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO, discoveryComplete bool) syncPlan {
+	var plan syncPlan
+	plan.Adopt = adoptableRegistrations(currentRegistrations, discoveredExtensions)
+	discoveredExtensions, plan.probeFailures = probeExtensions(ctx, currentRegistrations, discoveredExtensions)
+	if discoveryComplete {
+		for _, currentRegistration := range *currentRegistrations {
+			if containsUrl(discoveredExtensions, currentRegistration.Url) {
+				continue
+			}
+			if isManaged(currentRegistration.Url) || containsUrl(&plan.Adopt, currentRegistration.Url) {
+				plan.Remove = append(plan.Remove, currentRegistration)
+			} else {
+				log.Debug().Msgf("Extension: %s is not owned by the auto registration. Keep.", currentRegistration.Url)
+			}
+		}
+	} else {
+		log.Warn().Msg("Discovery was incomplete. Skip removal of registrations.")
+	}
+	for _, discoveredExtension := range *discoveredExtensions {
+		currentRegistration := findRegistration(currentRegistrations, discoveredExtension.Url)
+		if currentRegistration == nil {
+			plan.Add = append(plan.Add, discoveredExtension)
+		} else if registrationChanged(*currentRegistration, discoveredExtension) {
+			plan.Update = append(plan.Update, registrationUpdate{Current: *currentRegistration, Desired: discoveredExtension})
+		}
+	}
+	return plan
+}
+
+// applyPlan removes, updates and adds the planned registrations at the agent and returns an error if any of them
+// failed. In dry-run mode, the plan is only reported and the ownership is left unchanged.
+func applyPlan(ctx context.Context, httpClient *resty.Client, plan syncPlan) error {
+	if plan.probeFailures != nil {
+		// Probe failures are only kept in memory, so a dry run counts them as well to report removals like a sync would.
+		// Extensions that are no longer discovered start over.
+		probeFailures = plan.probeFailures
+	}
+	if extensionconfig.Config.DryRun {
+		reportPlan(plan)
+		return nil
+	}
+	adoptRegistrations(plan.Adopt)
+	failed := 0
+	for _, registration := range plan.Remove {
+		if !removeRegistration(ctx, httpClient, registration) {
+			failed++
+		}
+	}
+	for _, update := range plan.Update {
+		if !updateRegistration(ctx, httpClient, update.Current, update.Desired) {
+			failed++
+		}
+	}
+	for _, registration := range plan.Add {
+		if !addRegistration(ctx, httpClient, registration) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d registration changes failed", failed, len(plan.Remove)+len(plan.Update)+len(plan.Add))
+	}
+	return nil
+}
+
+// plannedRegistration is the JSON representation of a registration in a reported plan. Unlike the agent api, it
+// includes the cluster and task family.
+type plannedRegistration struct {
+	Url        string   `json:"url,omitempty"`
+	UnixSocket string   `json:"unixSocket,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	Cluster    string   `json:"cluster,omitempty"`
+	TaskFamily string   `json:"taskFamily,omitempty"`
+}
+
+type plannedUpdate struct {
+	Current plannedRegistration `json:"current"`
+	Desired plannedRegistration `json:"desired"`
+}
+
+type plannedSync struct {
+	Remove []plannedRegistration `json:"remove"`
+	Update []plannedUpdate       `json:"update"`
+	Add    []plannedRegistration `json:"add"`
+}
+
+func toPlannedRegistration(registration extensionConfigAO) plannedRegistration {
+	return plannedRegistration{
+		Url:        registration.Url,
+		UnixSocket: registration.UnixSocket,
+		Types:      registration.Types,
+		Cluster:    registration.Cluster,
+		TaskFamily: registration.TaskFamily,
+	}
+}
+
+func toPlannedSync(plan syncPlan) plannedSync {
+	planned := plannedSync{
+		Remove: make([]plannedRegistration, 0, len(plan.Remove)),
+		Update: make([]plannedUpdate, 0, len(plan.Update)),
+		Add:    make([]plannedRegistration, 0, len(plan.Add)),
+	}
+	for _, registration := range plan.Remove {
+		planned.Remove = append(planned.Remove, toPlannedRegistration(registration))
+	}
+	for _, update := range plan.Update {
+		planned.Update = append(planned.Update, plannedUpdate{Current: toPlannedRegistration(update.Current), Desired: toPlannedRegistration(update.Desired)})
+	}
+	for _, registration := range plan.Add {
+		planned.Add = append(planned.Add, toPlannedRegistration(registration))
+	}
+	return planned
+}
+
+// reportPlan logs the plan, or writes it as a single line of JSON to the plan output if the JSON format is configured.
+func reportPlan(plan syncPlan) {
+	if extensionconfig.Config.DryRunFormat == extensionconfig.DryRunFormatJson {
+		if err := writePlanJson(planOutput, plan); err != nil {
+			log.Error().Err(err).Msg("Failed to write sync plan.")
+		}
+		return
+	}
+	if plan.isEmpty() {
+		log.Info().Msg("Dry run: Registrations are in sync.")
+		return
+	}
+	for _, registration := range plan.Remove {
+		log.Info().Msgf("Dry run: Would remove extension: %s", registration.Url)
+	}
+	for _, update := range plan.Update {
+		log.Info().Msgf("Dry run: Would update extension: %s (cluster: %s). %s", update.Desired.Url, update.Desired.Cluster, describeChanges(update.Current, update.Desired))
+	}
+	for _, registration := range plan.Add {
+		log.Info().Msgf("Dry run: Would add extension: %s (cluster: %s) with types %v", registration.Url, registration.Cluster, registration.Types)
+	}
+}
+
+func writePlanJson(w io.Writer, plan syncPlan) error {
+	planJson, err := json.Marshal(toPlannedSync(plan))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(planJson))
+	return err
+}
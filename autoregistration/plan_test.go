@@ -0,0 +1,110 @@
+package autoregistration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/go-resty/resty/v2"
+	"github.com/jarcoal/httpmock"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_planSync(t *testing.T) {
+	unchanged := extensionConfigAO{Url: "http://10.0.0.1:8080", Types: []string{"ACTION"}}
+	changed := extensionConfigAO{Url: "http://10.0.0.2:8080", Types: []string{"ACTION", "DISCOVERY"}, Cluster: "steadybit-cluster"}
+	added := extensionConfigAO{Url: "http://10.0.0.3:8080", Types: []string{"ACTION"}, Cluster: "steadybit-cluster"}
+	owned := extensionConfigAO{Url: "http://10.0.0.4:8080", Types: []string{"ACTION"}}
+	manual := extensionConfigAO{Url: "http://99.99.99.99:9999", Types: []string{"ACTION"}}
+	current := []extensionConfigAO{unchanged, {Url: changed.Url, Types: []string{"ACTION"}}, owned, manual}
+	discovered := []extensionConfigAO{unchanged, changed, added}
+
+	tests := []struct {
+		name              string
+		discoveryComplete bool
+		want              syncPlan
+	}{
+		{
+			name:              "Should plan removal of owned registrations only",
+			discoveryComplete: true,
+			want: syncPlan{
+				Remove: []extensionConfigAO{owned},
+				Update: []registrationUpdate{{Current: current[1], Desired: changed}},
+				Add:    []extensionConfigAO{added},
+				Adopt:  []extensionConfigAO{unchanged, changed},
+			},
+		},
+		{
+			name:              "Should not plan removals if discovery was incomplete",
+			discoveryComplete: false,
+			want: syncPlan{
+				Update: []registrationUpdate{{Current: current[1], Desired: changed}},
+				Add:    []extensionConfigAO{added},
+				Adopt:  []extensionConfigAO{unchanged, changed},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(ownedRegistrations)
+			own(owned)
+
+			got := planSync(context.Background(), &current, &discovered, tt.discoveryComplete)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSync() = %v, want %v", got, tt.want)
+			}
+			if want := map[string]extensionConfigAO{owned.Url: owned}; !reflect.DeepEqual(ownedRegistrations, want) {
+				t.Errorf("ownedRegistrations after planSync() = %v, want %v", ownedRegistrations, want)
+			}
+		})
+	}
+}
+
+func Test_syncRegistrations_dryRun(t *testing.T) {
+	config.Config.DryRun = true
+	config.Config.DryRunFormat = config.DryRunFormatJson
+	config.Config.OwnershipStateFile = filepath.Join(t.TempDir(), "ownership.json")
+	var output bytes.Buffer
+	previousOutput := planOutput
+	planOutput = &output
+	defer func() {
+		config.Config.DryRun = false
+		config.Config.DryRunFormat = ""
+		config.Config.OwnershipStateFile = ""
+		planOutput = previousOutput
+	}()
+	client := resty.New()
+	client.SetBaseURL("http://localhost:42899")
+	httpmock.ActivateNonDefault(client.GetClient())
+	defer httpmock.Reset()
+	clear(ownedRegistrations)
+	ownedRegistrations["http://10.0.0.4:8080"] = extensionConfigAO{Url: "http://10.0.0.4:8080"}
+	wantOwned := maps.Clone(ownedRegistrations)
+
+	syncRegistrations(context.Background(), client, &[]extensionConfigAO{
+		{Url: "http://10.0.0.4:8080", Types: []string{"ACTION"}},
+		{Url: "http://10.0.0.5:8080", Types: []string{"ACTION"}},
+	}, &[]extensionConfigAO{
+		{Url: "http://10.0.0.3:8080", Types: []string{"ACTION"}, Cluster: "steadybit-cluster", TaskFamily: "steadybit-extension-test"},
+		{Url: "http://10.0.0.5:8080", Types: []string{"ACTION"}, Cluster: "steadybit-cluster", TaskFamily: "steadybit-extension-test"},
+	}, true)
+
+	if got := httpmock.GetTotalCallCount(); got != 0 {
+		t.Errorf("httpmock.GetTotalCallCount() = %v, want 0", got)
+	}
+	want := `{"remove":[{"url":"http://10.0.0.4:8080","types":["ACTION"]}],"update":[],"add":[{"url":"http://10.0.0.3:8080","types":["ACTION"],"cluster":"steadybit-cluster","taskFamily":"steadybit-extension-test"}]}` + "\n"
+	if got := output.String(); got != want {
+		t.Errorf("plan output = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(ownedRegistrations, wantOwned) {
+		t.Errorf("ownedRegistrations after dry run = %v, want %v", ownedRegistrations, wantOwned)
+	}
+	if _, err := os.Stat(config.Config.OwnershipStateFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("dry run must not write the ownership state file, stat error = %v", err)
+	}
+}
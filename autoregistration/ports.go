@@ -0,0 +1,94 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"strconv"
+)
+
+const (
+	// portMappingName is the name of the port mapping used as extension port if the port is neither tagged nor labelled
+	portMappingName = "steadybit"
+)
+
+// getExtensionPort returns the container port of the extension. If it is neither tagged nor labelled, it is derived from
+// the port mapping named `steadybit` or the only port mapping of the extension container, falling back to the only
+// network binding of the task.
+func getExtensionPort(ctx context.Context, cluster EcsCluster, task types.Task, metadata taskMetadata) (*string, error) {
+	if metadata.port != nil {
+		return metadata.port, nil
+	}
+	if task.TaskDefinitionArn != nil {
+		containerDefinitions, err := taskDefinitions.get(ctx, cluster, *task.TaskDefinitionArn)
+		if err != nil {
+			return nil, err
+		}
+		if port := portFromMappings(containerDefinitions, metadata.container); port != nil {
+			return port, nil
+		}
+	}
+	return portFromNetworkBindings(task, metadata.container), nil
+}
+
+func portFromMappings(containerDefinitions []types.ContainerDefinition, containerName *string) *string {
+	portMappings := make([]types.PortMapping, 0)
+	for _, containerDefinition := range containerDefinitions {
+		if containerName != nil && (containerDefinition.Name == nil || *containerDefinition.Name != *containerName) {
+			continue
+		}
+		portMappings = append(portMappings, containerDefinition.PortMappings...)
+	}
+	for _, portMapping := range portMappings {
+		if portMapping.Name != nil && *portMapping.Name == portMappingName && portMapping.ContainerPort != nil {
+			return new(strconv.Itoa(int(*portMapping.ContainerPort)))
+		}
+	}
+	if len(portMappings) == 1 && portMappings[0].ContainerPort != nil {
+		return new(strconv.Itoa(int(*portMappings[0].ContainerPort)))
+	}
+	return nil
+}
+
+func portFromNetworkBindings(task types.Task, containerName *string) *string {
+	networkBindings := make([]types.NetworkBinding, 0)
+	for _, container := range task.Containers {
+		if containerName != nil && (container.Name == nil || *container.Name != *containerName) {
+			continue
+		}
+		networkBindings = append(networkBindings, container.NetworkBindings...)
+	}
+	if len(networkBindings) == 1 && networkBindings[0].ContainerPort != nil {
+		return new(strconv.Itoa(int(*networkBindings[0].ContainerPort)))
+	}
+	return nil
+}
+
+// usesHostNetwork reports whether the task runs in bridge or host network mode, i.e. it has neither container network
+// interfaces nor an elastic network interface attachment (awsvpc).
+func usesHostNetwork(task types.Task) bool {
+	for _, container := range task.Containers {
+		if len(container.NetworkInterfaces) > 0 {
+			return false
+		}
+	}
+	for _, attachment := range task.Attachments {
+		if attachment.Type != nil && *attachment.Type == "ElasticNetworkInterface" {
+			return false
+		}
+	}
+	return true
+}
+
+// getHostPort returns the host port the given container port is mapped to in bridge or host network mode, so
+// dynamically mapped ports work. In awsvpc mode, or if the port is not bound, the container port is returned.
+func getHostPort(task types.Task, container *types.Container, containerPort string) string {
+	if container == nil || !usesHostNetwork(task) {
+		return containerPort
+	}
+	for _, binding := range container.NetworkBindings {
+		if binding.ContainerPort != nil && binding.HostPort != nil && strconv.Itoa(int(*binding.ContainerPort)) == containerPort {
+			return strconv.Itoa(int(*binding.HostPort))
+		}
+	}
+	return containerPort
+}
@@ -0,0 +1,131 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/stretchr/testify/mock"
+	"reflect"
+	"testing"
+)
+
+func Test_getExtensionPort(t *testing.T) {
+	bridgeTask := func(bindings ...types.NetworkBinding) types.Task {
+		return types.Task{
+			TaskArn:           new(taskArn(1)),
+			TaskDefinitionArn: new("arn:aws:ecs:eu-central-1:123456789012:task-definition/steadybit-extension-test:1"),
+			Containers:        []types.Container{{Name: new("extension"), NetworkBindings: bindings}},
+		}
+	}
+	tests := []struct {
+		name                 string
+		metadata             taskMetadata
+		containerDefinitions []types.ContainerDefinition
+		task                 types.Task
+		want                 *string
+	}{
+		{
+			name:     "Should use tagged port",
+			metadata: taskMetadata{port: new("8080")},
+			task:     bridgeTask(),
+			want:     new("8080"),
+		},
+		{
+			name: "Should use port mapping named steadybit",
+			containerDefinitions: []types.ContainerDefinition{
+				{Name: new("extension"), PortMappings: []types.PortMapping{
+					{ContainerPort: new(int32(9090)), Name: new("metrics")},
+					{ContainerPort: new(int32(8085)), Name: new("steadybit")},
+				}},
+			},
+			task: bridgeTask(),
+			want: new("8085"),
+		},
+		{
+			name: "Should use the only port mapping",
+			containerDefinitions: []types.ContainerDefinition{
+				{Name: new("log-router")},
+				{Name: new("extension"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(8086))}}},
+			},
+			task: bridgeTask(),
+			want: new("8086"),
+		},
+		{
+			name:     "Should only use port mappings of the labelled container",
+			metadata: taskMetadata{container: new("extension")},
+			containerDefinitions: []types.ContainerDefinition{
+				{Name: new("log-router"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(24224))}}},
+				{Name: new("extension"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(8086))}}},
+			},
+			task: bridgeTask(),
+			want: new("8086"),
+		},
+		{
+			name: "Should fall back to the only network binding",
+			containerDefinitions: []types.ContainerDefinition{
+				{Name: new("extension"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(8087))}, {ContainerPort: new(int32(9090))}}},
+			},
+			task: bridgeTask(types.NetworkBinding{ContainerPort: new(int32(8087)), HostPort: new(int32(32768))}),
+			want: new("8087"),
+		},
+		{
+			name: "Should not guess between multiple ports",
+			containerDefinitions: []types.ContainerDefinition{
+				{Name: new("extension"), PortMappings: []types.PortMapping{{ContainerPort: new(int32(8087))}, {ContainerPort: new(int32(9090))}}},
+			},
+			task: bridgeTask(),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(taskDefinitions.entries)
+			ecsMock := new(ecsClientApiMock)
+			ecsMock.On("DescribeTaskDefinition", mock.Anything, mock.Anything).Return(&ecs.DescribeTaskDefinitionOutput{
+				TaskDefinition: &types.TaskDefinition{ContainerDefinitions: tt.containerDefinitions},
+			}, nil)
+			var ecsClient EcsApi = ecsMock
+			cluster := EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient}
+
+			got, err := getExtensionPort(context.Background(), cluster, tt.task, tt.metadata)
+			if err != nil {
+				t.Fatalf("getExtensionPort() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getExtensionPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getHostPort(t *testing.T) {
+	container := types.Container{
+		Name:            new("extension"),
+		NetworkBindings: []types.NetworkBinding{{ContainerPort: new(int32(8080)), HostPort: new(int32(32768))}},
+	}
+	awsvpcContainer := container
+	awsvpcContainer.NetworkInterfaces = []types.NetworkInterface{{PrivateIpv4Address: new("10.0.0.1")}}
+	tests := []struct {
+		name string
+		task types.Task
+		want string
+	}{
+		{
+			name: "Should use dynamically mapped host port in bridge mode",
+			task: types.Task{Containers: []types.Container{container}},
+			want: "32768",
+		},
+		{
+			name: "Should use container port in awsvpc mode",
+			task: types.Task{Containers: []types.Container{awsvpcContainer}},
+			want: "8080",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getHostPort(tt.task, &tt.task.Containers[0], "8080"); got != tt.want {
+				t.Errorf("getHostPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package autoregistration
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"strings"
+	"time"
+)
+
+var (
+	//nolint:gosec // extensions are registered by ip, the agent verifies their certificates
+	probeClient = resty.New().SetTLSClientConfig(&tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true}).SetDisableWarn(true)
+	// probeFailures counts the consecutive failed probes per extension url
+	probeFailures = make(map[string]int)
+)
+
+// probeExtensions probes all discovered extensions, if enabled, and returns the extensions that should be registered:
+// Extensions that are not registered yet need to pass the probe, registered extensions are kept until they failed the
+// configured number of consecutive probes. The returned extensions are then synced as usual, so registrations of
+// unhealthy extensions are removed. The consecutive failures per url are returned as well, they are only stored when
+// the sync plan is applied. If probes are disabled, the failures are nil.
+func probeExtensions(ctx context.Context, currentRegistrations *[]extensionConfigAO, discoveredExtensions *[]extensionConfigAO) (*[]extensionConfigAO, map[string]int) {
+	if !extensionconfig.Config.ExtensionProbe {
+		return discoveredExtensions, nil
+	}
+	healthy := make([]bool, len(*discoveredExtensions))
+	forEachConcurrently(len(*discoveredExtensions), func(i int) {
+		healthy[i] = probeExtension(ctx, (*discoveredExtensions)[i])
+	})
+
+	failures := make(map[string]int, len(*discoveredExtensions))
+	healthyExtensions := make([]extensionConfigAO, 0, len(*discoveredExtensions))
+	for i, extension := range *discoveredExtensions {
+		failures[extension.Url] = recordProbe(extension, healthy[i])
+		registered := containsUrl(currentRegistrations, extension.Url)
+		switch {
+		case healthy[i]:
+			healthyExtensions = append(healthyExtensions, extension)
+		case !registered:
+			log.Info().Msgf("Extension: %s (cluster: %s) is not healthy yet. Skip registration.", extension.Url, extension.Cluster)
+		case failures[extension.Url] < extensionconfig.Config.ExtensionProbeMaxFailures:
+			healthyExtensions = append(healthyExtensions, extension)
+		default:
+			log.Warn().Msgf("Extension: %s (cluster: %s) failed %d probes in a row. Remove registration.", extension.Url, extension.Cluster, failures[extension.Url])
+		}
+	}
+	return &healthyExtensions, failures
+}
+
+// isHealthy probes a single extension, if enabled, e.g. before registering a started task.
+func isHealthy(ctx context.Context, extension extensionConfigAO) bool {
+	if !extensionconfig.Config.ExtensionProbe {
+		return true
+	}
+	healthy := probeExtension(ctx, extension)
+	probeFailures[extension.Url] = recordProbe(extension, healthy)
+	return healthy
+}
+
+// recordProbe logs and counts the probe result and returns the number of consecutive failures.
+func recordProbe(extension extensionConfigAO, healthy bool) int {
+	if healthy {
+		extensionProbes.WithLabelValues(probeResultSuccess).Inc()
+		if probeFailures[extension.Url] > 0 {
+			log.Info().Msgf("Extension: %s (cluster: %s) is healthy again.", extension.Url, extension.Cluster)
+		}
+		return 0
+	}
+	extensionProbes.WithLabelValues(probeResultFailure).Inc()
+	return probeFailures[extension.Url] + 1
+}
+
+func probeExtension(ctx context.Context, extension extensionConfigAO) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(extensionconfig.Config.ExtensionProbeTimeout)*time.Second)
+	defer cancel()
+	probeUrl := strings.TrimSuffix(extension.Url, "/") + "/" + strings.TrimPrefix(extensionconfig.Config.ExtensionProbePath, "/")
+	done := observeApiCall(apiExtension, "Probe")
+	resp, err := probeClient.R().SetContext(ctx).Get(probeUrl)
+	done()
+	if err != nil {
+		log.Warn().Err(err).Msgf("Probe of extension: %s (cluster: %s) failed.", probeUrl, extension.Cluster)
+		return false
+	}
+	if !resp.IsSuccess() {
+		log.Warn().Msgf("Probe of extension: %s (cluster: %s) failed. Status: %s", probeUrl, extension.Cluster, resp.Status())
+		return false
+	}
+	log.Debug().Msgf("Probe of extension: %s (cluster: %s) succeeded.", probeUrl, extension.Cluster)
+	return true
+}
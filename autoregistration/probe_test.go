@@ -0,0 +1,70 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_probeExtensions(t *testing.T) {
+	config.Config.ExtensionProbe = true
+	config.Config.ExtensionProbePath = "/"
+	config.Config.ExtensionProbeTimeout = 1
+	config.Config.ExtensionProbeMaxFailures = 2
+	defer func() { config.Config.ExtensionProbe = false }()
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthyServer.Close()
+	unhealthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthyServer.Close()
+	healthy := extensionConfigAO{Url: healthyServer.URL, Types: []string{"ACTION"}}
+	unhealthy := extensionConfigAO{Url: unhealthyServer.URL, Types: []string{"ACTION"}}
+
+	tests := []struct {
+		name                 string
+		currentRegistrations []extensionConfigAO
+		previousFailures     map[string]int
+		want                 []extensionConfigAO
+		wantFailures         map[string]int
+	}{
+		{
+			name:         "Should not register unhealthy extensions",
+			want:         []extensionConfigAO{healthy},
+			wantFailures: map[string]int{healthy.Url: 0, unhealthy.Url: 1},
+		},
+		{
+			name:                 "Should keep registered extensions until max failures",
+			currentRegistrations: []extensionConfigAO{healthy, unhealthy},
+			want:                 []extensionConfigAO{healthy, unhealthy},
+			wantFailures:         map[string]int{healthy.Url: 0, unhealthy.Url: 1},
+		},
+		{
+			name:                 "Should remove registered extensions after max failures",
+			currentRegistrations: []extensionConfigAO{healthy, unhealthy},
+			previousFailures:     map[string]int{unhealthy.Url: 1, "http://10.0.0.1:8080": 2},
+			want:                 []extensionConfigAO{healthy},
+			wantFailures:         map[string]int{healthy.Url: 0, unhealthy.Url: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probeFailures = map[string]int{}
+			for url, failures := range tt.previousFailures {
+				probeFailures[url] = failures
+			}
+			got, gotFailures := probeExtensions(context.Background(), &tt.currentRegistrations, &[]extensionConfigAO{healthy, unhealthy})
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("probeExtensions() = %v, want %v", *got, tt.want)
+			}
+			if !reflect.DeepEqual(gotFailures, tt.wantFailures) {
+				t.Errorf("probeExtensions() failures = %v, want %v", gotFailures, tt.wantFailures)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package autoregistration
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	schemeHttp      = "http"
+	schemeHttps     = "https"
+	tlsCheckTimeout = 5 * time.Second
+)
+
+// getScheme returns the tagged or labelled scheme of the extension, falling back to the configured default.
+func getScheme(metadata taskMetadata) string {
+	if metadata.scheme != nil {
+		return *metadata.scheme
+	}
+	if extensionconfig.Config.ExtensionScheme != "" {
+		return extensionconfig.Config.ExtensionScheme
+	}
+	return schemeHttp
+}
+
+// isTlsReachable reports whether a TLS handshake with the extension succeeds, if the TLS check is enabled and the
+// extension uses https. The certificate itself is verified by the agent, as the extension is registered by ip.
+func isTlsReachable(ctx context.Context, registration extensionConfigAO) bool {
+	if !extensionconfig.Config.ExtensionTlsCheck {
+		return true
+	}
+	extensionUrl, err := url.Parse(registration.Url)
+	if err != nil || extensionUrl.Scheme != schemeHttps {
+		return true
+	}
+	if err := checkTlsHandshake(ctx, extensionUrl.Host); err != nil {
+		log.Warn().Err(err).Msgf("Extension: %s (cluster: %s) is not reachable via TLS. Skip registration.", registration.Url, registration.Cluster)
+		return false
+	}
+	return true
+}
+
+func checkTlsHandshake(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, tlsCheckTimeout)
+	defer cancel()
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{},
+		//nolint:gosec // only the reachability is checked, the agent verifies the certificate
+		Config: &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true},
+	}
+	connection, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("tls handshake failed: %w", err)
+	}
+	return connection.Close()
+}
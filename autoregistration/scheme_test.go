@@ -0,0 +1,115 @@
+package autoregistration
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_buildExtension_scheme(t *testing.T) {
+	withScheme := func(scheme string) types.Task {
+		task := replicaTask(1)
+		task.Tags = append(task.Tags, types.Tag{Key: new("steadybit_extension_scheme"), Value: new(scheme)})
+		return task
+	}
+	tests := []struct {
+		name          string
+		defaultScheme string
+		task          types.Task
+		want          string
+	}{
+		{
+			name: "Should use http by default",
+			task: replicaTask(1),
+			want: "http://10.0.0.1:8080",
+		},
+		{
+			name:          "Should use configured default scheme",
+			defaultScheme: "https",
+			task:          replicaTask(1),
+			want:          "https://10.0.0.1:8080",
+		},
+		{
+			name: "Should use tagged scheme",
+			task: withScheme("https"),
+			want: "https://10.0.0.1:8080",
+		},
+		{
+			name: "Should ignore task with invalid scheme",
+			task: withScheme("ftp"),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.ExtensionScheme = tt.defaultScheme
+			defer func() { config.Config.ExtensionScheme = "" }()
+
+			got, err := buildExtension(context.Background(), EcsCluster{Name: "steadybit-cluster"}, tt.task, true)
+			if err != nil {
+				t.Fatalf("buildExtension() error = %v", err)
+			}
+			gotUrl := ""
+			if got != nil {
+				gotUrl = got.Url
+			}
+			if gotUrl != tt.want {
+				t.Errorf("buildExtension() url = %v, want %v", gotUrl, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isTlsReachable(t *testing.T) {
+	config.Config.ExtensionTlsCheck = true
+	defer func() { config.Config.ExtensionTlsCheck = false }()
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(http.NotFoundHandler())
+	defer plainServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := listener.Addr().String()
+	_ = listener.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{
+			name: "Should be reachable via TLS",
+			url:  tlsServer.URL,
+			want: true,
+		},
+		{
+			name: "Should not be reachable if extension does not speak TLS",
+			url:  strings.Replace(plainServer.URL, "http://", "https://", 1),
+			want: false,
+		},
+		{
+			name: "Should not be reachable if port is closed",
+			url:  "https://" + closedAddress,
+			want: false,
+		},
+		{
+			name: "Should not check http extensions",
+			url:  "http://" + closedAddress,
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTlsReachable(context.Background(), extensionConfigAO{Url: tt.url}); got != tt.want {
+				t.Errorf("isTlsReachable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package autoregistration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"path"
+	"slices"
+)
+
+// discoverTaggedTasks discovers the extensions of all running tasks of the cluster, or of the configured services, that
+// are tagged or labelled with the extension port and whose task family is selected by the allow and deny list.
+func discoverTaggedTasks(ctx context.Context, cluster EcsCluster) ([]extensionConfigAO, error) {
+	taskArns, err := listTaggedTaskCandidates(ctx, cluster)
+	tasks := make([]types.Task, 0)
+	if len(taskArns) > 0 {
+		describedTasks, describeErr := describeTasks(ctx, cluster, taskArns)
+		if describeErr != nil {
+			log.Warn().Err(describeErr).Msgf("Failed to describe tasks in cluster: %s. Discovery is incomplete.", cluster.Name)
+			return []extensionConfigAO{}, fmt.Errorf("cluster %s: failed to describe tasks: %w", cluster.Name, describeErr)
+		}
+		for _, task := range describedTasks {
+			if task.TaskDefinitionArn == nil || !isTaskFamilySelected(taskFamily(*task.TaskDefinitionArn)) {
+				continue
+			}
+			metadata, metadataErr := getTaskMetadata(ctx, cluster, task)
+			if metadataErr != nil {
+				log.Warn().Err(metadataErr).Msgf("Failed to describe task definition of task: %s in cluster: %s. Discovery is incomplete.", *task.TaskArn, cluster.Name)
+				err = errors.Join(err, fmt.Errorf("cluster %s: failed to describe task definition: %w", cluster.Name, metadataErr))
+				continue
+			}
+			if metadata.port != nil {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+
+	discoveredExtensions, extensionsErr := toExtensions(ctx, cluster, tasks)
+	if extensionsErr != nil {
+		log.Warn().Err(extensionsErr).Msgf("Failed to discover extensions in cluster: %s. Discovery is incomplete.", cluster.Name)
+		err = errors.Join(err, fmt.Errorf("cluster %s: %w", cluster.Name, extensionsErr))
+	}
+
+	if err != nil {
+		discoveryFailures.WithLabelValues(cluster.Name, unknownTaskFamily).Inc()
+	} else {
+		recordTaggedExtensions(cluster.Name, discoveredExtensions)
+	}
+	return discoveredExtensions, err
+}
+
+// listTaggedTaskCandidates lists the running tasks of the configured services, or of the whole cluster if no services
+// are configured. If listing the tasks of a service fails, the tasks of the other services are still returned.
+func listTaggedTaskCandidates(ctx context.Context, cluster EcsCluster) ([]string, error) {
+	if len(extensionconfig.Config.Services) == 0 {
+		taskArns, err := listTaskArns(ctx, cluster, &ecs.ListTasksInput{})
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to list tasks in cluster: %s. Discovery is incomplete.", cluster.Name)
+			return nil, fmt.Errorf("cluster %s: failed to list tasks: %w", cluster.Name, err)
+		}
+		return taskArns, nil
+	}
+	services := extensionconfig.Config.Services
+	serviceTaskArns := make([][]string, len(services))
+	errs := make([]error, len(services))
+	forEachConcurrently(len(services), func(i int) {
+		taskArns, err := listTaskArns(ctx, cluster, &ecs.ListTasksInput{ServiceName: &services[i]})
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to list tasks of service: %s in cluster: %s. Discovery is incomplete.", services[i], cluster.Name)
+			errs[i] = fmt.Errorf("cluster %s, service %s: failed to list tasks: %w", cluster.Name, services[i], err)
+			return
+		}
+		serviceTaskArns[i] = taskArns
+	})
+	taskArns := make([]string, 0)
+	for _, arns := range serviceTaskArns {
+		taskArns = append(taskArns, arns...)
+	}
+	return taskArns, errors.Join(errs...)
+}
+
+// isTaskFamilySelected reports whether tasks of the given family are discovered. In task family mode, the family needs
+// to be configured. In tag mode, it needs to match the allow list, if any, and must not match the deny list.
+func isTaskFamilySelected(taskFamily string) bool {
+	if extensionconfig.Config.DiscoveryMode != extensionconfig.DiscoveryModeTags {
+		return slices.Contains(extensionconfig.Config.TaskFamilies, taskFamily)
+	}
+	allowList := extensionconfig.Config.TaskFamilyAllowList
+	return (len(allowList) == 0 || matchesAny(allowList, taskFamily)) && !matchesAny(extensionconfig.Config.TaskFamilyDenyList, taskFamily)
+}
+
+// isTaskSelected reports whether the given task is discovered in tag mode, i.e. it is tagged or labelled with the
+// extension port and belongs to one of the configured services, if any. Tasks are always selected in task family mode.
+func isTaskSelected(ctx context.Context, cluster EcsCluster, task types.Task) bool {
+	if extensionconfig.Config.DiscoveryMode != extensionconfig.DiscoveryModeTags {
+		return true
+	}
+	if metadata, err := getTaskMetadata(ctx, cluster, task); err != nil || metadata.port == nil {
+		return false
+	}
+	return len(extensionconfig.Config.Services) == 0 || (task.Group != nil && slices.ContainsFunc(extensionconfig.Config.Services, func(service string) bool {
+		return *task.Group == "service:"+service
+	}))
+}
+
+// matchesAny reports whether the value matches any of the given glob patterns, e.g. `steadybit-extension-*`.
+func matchesAny(patterns []string, value string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, err := path.Match(pattern, value)
+		return err == nil && matched
+	})
+}
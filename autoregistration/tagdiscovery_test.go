@@ -0,0 +1,161 @@
+package autoregistration
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"github.com/stretchr/testify/mock"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func taggedTask(i int, taskFamily string, service string) types.Task {
+	task := replicaTask(i)
+	task.TaskDefinitionArn = new("arn:aws:ecs:eu-central-1:123456789012:task-definition/" + taskFamily + ":1")
+	task.Group = new("service:" + service)
+	return task
+}
+
+func untaggedTask(i int) types.Task {
+	task := taggedTask(i, "steadybit-agent", "steadybit-agent")
+	task.Tags = nil
+	return task
+}
+
+func labelledTask(i int, taskFamily string, service string) types.Task {
+	task := untaggedTask(i)
+	task.TaskDefinitionArn = new("arn:aws:ecs:eu-central-1:123456789012:task-definition/" + taskFamily + ":1")
+	task.Group = new("service:" + service)
+	task.Containers[0].Name = new("extension")
+	return task
+}
+
+// describeTasksFake describes the requested tasks out of the given ones.
+type describeTasksFake struct {
+	ecsClientApiMock
+	tasks []types.Task
+}
+
+func (f *describeTasksFake) DescribeTasks(_ context.Context, input *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	output := &ecs.DescribeTasksOutput{}
+	for _, task := range f.tasks {
+		if slices.Contains(input.Tasks, *task.TaskArn) {
+			output.Tasks = append(output.Tasks, task)
+		}
+	}
+	return output, nil
+}
+
+func Test_discoverTaggedTasks(t *testing.T) {
+	tasks := []types.Task{
+		taggedTask(1, "steadybit-extension-host", "steadybit-extension-host"),
+		taggedTask(2, "steadybit-extension-jvm", "steadybit-extension-jvm"),
+		taggedTask(3, "custom-extension", "custom-extension"),
+		untaggedTask(4),
+		labelledTask(5, "labelled-extension", "labelled-extension"),
+	}
+	tests := []struct {
+		name      string
+		services  []string
+		allowList []string
+		denyList  []string
+		listTasks func(ecsMock *ecsClientApiMock)
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name: "Should discover all tagged tasks of the cluster",
+			listTasks: func(ecsMock *ecsClientApiMock) {
+				ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+					return input.Family == nil && input.ServiceName == nil
+				})).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(1), taskArn(2), taskArn(3), taskArn(4), taskArn(5)}}, nil)
+			},
+			want: []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.5:8081"},
+		},
+		{
+			name:      "Should filter task families by allow and deny list",
+			allowList: []string{"steadybit-extension-*"},
+			denyList:  []string{"*-jvm"},
+			listTasks: func(ecsMock *ecsClientApiMock) {
+				ecsMock.On("ListTasks", mock.Anything, mock.Anything).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(1), taskArn(2), taskArn(3), taskArn(4), taskArn(5)}}, nil)
+			},
+			want: []string{"http://10.0.0.1:8080"},
+		},
+		{
+			name:     "Should discover tagged tasks of the configured services",
+			services: []string{"steadybit-extension-jvm", "custom-extension"},
+			listTasks: func(ecsMock *ecsClientApiMock) {
+				ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+					return *input.ServiceName == "steadybit-extension-jvm"
+				})).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(2)}}, nil)
+				ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+					return *input.ServiceName == "custom-extension"
+				})).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(3)}}, nil)
+			},
+			want: []string{"http://10.0.0.2:8080", "http://10.0.0.3:8080"},
+		},
+		{
+			name:     "Should return tasks of other services if listing a service fails",
+			services: []string{"steadybit-extension-jvm", "custom-extension"},
+			listTasks: func(ecsMock *ecsClientApiMock) {
+				ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+					return *input.ServiceName == "steadybit-extension-jvm"
+				})).Return(nil, errors.New("ThrottlingException"))
+				ecsMock.On("ListTasks", mock.Anything, mock.MatchedBy(func(input *ecs.ListTasksInput) bool {
+					return *input.ServiceName == "custom-extension"
+				})).Return(&ecs.ListTasksOutput{TaskArns: []string{taskArn(3)}}, nil)
+			},
+			want:    []string{"http://10.0.0.3:8080"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.DiscoveryMode = config.DiscoveryModeTags
+			config.Config.Services = tt.services
+			config.Config.TaskFamilyAllowList = tt.allowList
+			config.Config.TaskFamilyDenyList = tt.denyList
+			defer func() {
+				config.Config.DiscoveryMode = config.DiscoveryModeTaskFamilies
+				config.Config.Services = nil
+				config.Config.TaskFamilyAllowList = nil
+				config.Config.TaskFamilyDenyList = nil
+			}()
+
+			ecsMock := &describeTasksFake{tasks: tasks}
+			tt.listTasks(&ecsMock.ecsClientApiMock)
+			ecsMock.On("DescribeTaskDefinition", mock.Anything, mock.MatchedBy(func(input *ecs.DescribeTaskDefinitionInput) bool {
+				return strings.Contains(*input.TaskDefinition, "/labelled-extension:")
+			})).Return(&ecs.DescribeTaskDefinitionOutput{TaskDefinition: &types.TaskDefinition{
+				ContainerDefinitions: []types.ContainerDefinition{
+					{Name: new("log-router")},
+					{Name: new("extension"), DockerLabels: map[string]string{"steadybit.extension.port": "8081", "steadybit.extension.types": "ACTION,DISCOVERY"}},
+				},
+			}}, nil)
+			ecsMock.On("DescribeTaskDefinition", mock.Anything, mock.Anything).Return(&ecs.DescribeTaskDefinitionOutput{TaskDefinition: &types.TaskDefinition{
+				ContainerDefinitions: []types.ContainerDefinition{{Name: new("steadybit-agent")}},
+			}}, nil)
+			clear(taskDefinitions.entries)
+			var ecsClient EcsApi = ecsMock
+			var ec2Client Ec2Api = new(ec2ClientApiMock)
+			cluster := EcsCluster{Name: "steadybit-cluster", EcsClient: &ecsClient, Ec2Client: &ec2Client}
+
+			got, err := discoverExtensions(context.Background(), []EcsCluster{cluster})
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("discoverExtensions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			urls := make([]string, 0)
+			for _, extension := range got {
+				urls = append(urls, extension.Url)
+			}
+			if !reflect.DeepEqual(urls, tt.want) {
+				t.Errorf("discoverExtensions() = %v, want %v", urls, tt.want)
+			}
+		})
+	}
+}
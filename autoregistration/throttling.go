@@ -0,0 +1,92 @@
+package autoregistration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/rs/zerolog/log"
+	extensionconfig "github.com/steadybit/extension-auto-registration-ecs/config"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errAwsCallBudgetExhausted = errors.New("AWS api call budget of the sync is exhausted")
+	isThrottleError           = retry.IsErrorThrottles(retry.DefaultThrottles)
+	// awsRequestSlots limits the concurrent AWS requests to the discovery concurrency, no matter how many clusters,
+	// families and batches are discovered at once
+	awsRequestSlots = sync.OnceValue(func() chan struct{} {
+		return make(chan struct{}, discoveryConcurrency())
+	})
+)
+
+// awsCallBudgetKey is the context key of the call budget of a sync
+type awsCallBudgetKey struct{}
+
+// awsCallBudget counts the AWS requests of a sync, including retries, and denies requests beyond the configured
+// budget. It is safe for concurrent use.
+type awsCallBudget struct {
+	calls     atomic.Int64
+	exhausted atomic.Bool
+}
+
+// withAwsCallBudget returns a context carrying a new call budget, which all AWS requests made with the context are
+// counted against. Requests without a budget, e.g. those of handled task state change events, are not limited.
+func withAwsCallBudget(ctx context.Context) (context.Context, *awsCallBudget) {
+	budget := &awsCallBudget{}
+	return context.WithValue(ctx, awsCallBudgetKey{}, budget), budget
+}
+
+// spend counts a request and reports whether it is within the budget. A budget of 0 is unlimited.
+func (b *awsCallBudget) spend() bool {
+	calls := b.calls.Add(1)
+	budget := int64(extensionconfig.Config.AwsCallBudget)
+	if budget <= 0 || calls <= budget {
+		return true
+	}
+	if b.exhausted.CompareAndSwap(false, true) {
+		log.Warn().Msgf("AWS api call budget of %d calls per sync is exhausted. Discovery is incomplete, registrations are not removed.", budget)
+		awsCallBudgetExhausted.Inc()
+	}
+	return false
+}
+
+func (b *awsCallBudget) used() int64 {
+	return b.calls.Load()
+}
+
+// AwsApiOptions returns the middleware to add to the ECS and EC2 clients. It is inserted after the retry middleware, so
+// every attempt waits for a free request slot, is counted against the call budget of the sync, if any, and is recorded
+// if throttled.
+func AwsApiOptions() []func(*middleware.Stack) error {
+	return []func(*middleware.Stack) error{
+		func(stack *middleware.Stack) error {
+			return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("SteadybitAwsCallBudget", handleAwsAttempt), "Retry", middleware.After)
+		},
+	}
+}
+
+func handleAwsAttempt(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	api := strings.ToLower(awsmiddleware.GetServiceID(ctx))
+	operation := awsmiddleware.GetOperationName(ctx)
+	select {
+	case awsRequestSlots() <- struct{}{}:
+		defer func() { <-awsRequestSlots() }()
+	case <-ctx.Done():
+		return middleware.FinalizeOutput{}, middleware.Metadata{}, ctx.Err()
+	}
+	if budget, ok := ctx.Value(awsCallBudgetKey{}).(*awsCallBudget); ok && !budget.spend() {
+		return middleware.FinalizeOutput{}, middleware.Metadata{}, fmt.Errorf("%s %s: %w", api, operation, errAwsCallBudgetExhausted)
+	}
+	out, metadata, err := next.HandleFinalize(ctx, in)
+	if err != nil && isThrottleError.IsErrorThrottle(err) == aws.TrueTernary {
+		log.Warn().Err(err).Msgf("AWS api call %s %s was throttled.", api, operation)
+		awsThrottledCalls.WithLabelValues(api, operation).Inc()
+	}
+	return out, metadata, err
+}
@@ -0,0 +1,102 @@
+package autoregistration
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/steadybit/extension-auto-registration-ecs/config"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func Test_awsCallBudget(t *testing.T) {
+	config.Config.AwsCallBudget = 2
+	defer func() { config.Config.AwsCallBudget = 0 }()
+	budget := &awsCallBudget{}
+
+	got := []bool{budget.spend(), budget.spend(), budget.spend()}
+	if want := []bool{true, true, false}; !slices.Equal(got, want) {
+		t.Errorf("spend() = %v, want %v", got, want)
+	}
+}
+
+func Test_AwsApiOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		budget        int
+		withoutBudget bool
+		wantErr       error
+		wantRequests  int
+		wantThrottled float64
+	}{
+		{
+			name:          "Should record throttled calls and count retries against the budget",
+			wantRequests:  2,
+			wantThrottled: 1,
+		},
+		{
+			name:          "Should deny requests beyond the budget",
+			budget:        1,
+			wantErr:       errAwsCallBudgetExhausted,
+			wantRequests:  1,
+			wantThrottled: 1,
+		},
+		{
+			name:          "Should not count requests without a sync against the budget",
+			budget:        1,
+			withoutBudget: true,
+			wantRequests:  2,
+			wantThrottled: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.AwsCallBudget = tt.budget
+			defer func() { config.Config.AwsCallBudget = 0 }()
+			requests := 0
+			// the first request is throttled, the retry succeeds
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				if requests == 1 {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"__type":"ThrottlingException","message":"Rate exceeded"}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"taskArns":[]}`))
+			}))
+			defer server.Close()
+			client := ecs.New(ecs.Options{
+				Region:       "eu-central-1",
+				BaseEndpoint: aws.String(server.URL),
+				Credentials:  aws.AnonymousCredentials{},
+				Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+					o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+				}),
+				APIOptions: AwsApiOptions(),
+			})
+			ctx := context.Background()
+			if !tt.withoutBudget {
+				ctx, _ = withAwsCallBudget(ctx)
+			}
+			awsThrottledCalls.Reset()
+
+			_, err := client.ListTasks(ctx, &ecs.ListTasksInput{})
+			if tt.wantErr == nil && err != nil || !errors.Is(err, tt.wantErr) {
+				t.Errorf("ListTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("requests = %v, want %v", requests, tt.wantRequests)
+			}
+			if got := testutil.ToFloat64(awsThrottledCalls.WithLabelValues("ecs", "ListTasks")); got != tt.wantThrottled {
+				t.Errorf("throttled calls = %v, want %v", got, tt.wantThrottled)
+			}
+		})
+	}
+}
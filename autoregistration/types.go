@@ -4,4 +4,8 @@ type extensionConfigAO struct {
 	UnixSocket string   `json:"unixSocket,omitempty"`
 	Url        string   `json:"url,omitempty"`
 	Types      []string `json:"types,omitempty"`
+	// Cluster is the ECS cluster the extension was discovered in. It is only used internally and not sent to the agent.
+	Cluster string `json:"-"`
+	// TaskFamily is the task family of the extension's task. It is only used internally and not sent to the agent.
+	TaskFamily string `json:"-"`
 }
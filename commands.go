@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/steadybit/extension-auto-registration-ecs/autoregistration"
+	"os"
+)
+
+const usage = `Usage: extension [command]
+
+Without a command, the sidecar keeps syncing the extensions with the agent. All commands use the same configuration.
+
+Commands:
+  discover [--output table|json]   Discover the extensions once and print them
+  diff [--output table|json]       Print the changes a sync would apply to the agent's registrations
+  sync --once                      Sync once and exit with a non-zero code on failures
+`
+
+// runCommand runs a one-shot command and returns the exit code of the process.
+func runCommand(ctx context.Context, args []string, httpClientAgent *resty.Client, clusters []autoregistration.EcsCluster) int {
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		_, _ = fmt.Fprint(os.Stdout, usage)
+		return 0
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() { _, _ = fmt.Fprint(os.Stderr, usage) }
+	output := flags.String("output", autoregistration.OutputFormatTable, "output format, either table or json")
+	once := flags.Bool("once", false, "sync once and exit")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "discover":
+		err = autoregistration.Discover(ctx, clusters, os.Stdout, *output)
+	case "diff":
+		err = autoregistration.Diff(ctx, httpClientAgent, clusters, os.Stdout, *output)
+	case "sync":
+		if !*once {
+			_, _ = fmt.Fprint(os.Stderr, "sync requires --once, start without a command to sync continuously\n\n"+usage)
+			return 2
+		}
+		err = autoregistration.UpdateAgentExtensions(ctx, httpClientAgent, clusters)
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", args[0], usage)
+		return 2
+	}
+	if err != nil {
+		zlog.Error().Err(err).Msgf("Command %s failed.", args[0])
+		return 1
+	}
+	return 0
+}
@@ -6,6 +6,8 @@ package config
 import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog/log"
+	"path"
+	"slices"
 )
 
 var (
@@ -17,4 +19,32 @@ func ParseConfiguration() {
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Failed to parse configuration from environment.")
 	}
+	if len(Config.GetEcsClusters()) == 0 {
+		log.Fatal().Msgf("Either STEADYBIT_EXTENSION_ECS_CLUSTER_NAME or STEADYBIT_EXTENSION_ECS_CLUSTERS must be configured.")
+	}
+	for _, cluster := range Config.GetEcsClusters() {
+		if cluster.Name == "" {
+			log.Fatal().Msgf("Every cluster in STEADYBIT_EXTENSION_ECS_CLUSTERS needs a name.")
+		}
+	}
+	if Config.DiscoveryMode != DiscoveryModeTaskFamilies && Config.DiscoveryMode != DiscoveryModeTags {
+		log.Fatal().Msgf("STEADYBIT_EXTENSION_DISCOVERY_MODE must be either '%s' or '%s'.", DiscoveryModeTaskFamilies, DiscoveryModeTags)
+	}
+	if Config.MetadataPrecedence != MetadataPrecedenceTags && Config.MetadataPrecedence != MetadataPrecedenceLabels {
+		log.Fatal().Msgf("STEADYBIT_EXTENSION_METADATA_PRECEDENCE must be either '%s' or '%s'.", MetadataPrecedenceTags, MetadataPrecedenceLabels)
+	}
+	if Config.ExtensionScheme != "http" && Config.ExtensionScheme != "https" {
+		log.Fatal().Msgf("STEADYBIT_EXTENSION_EXTENSION_SCHEME must be either 'http' or 'https'.")
+	}
+	if Config.AwsRetryMode != "standard" && Config.AwsRetryMode != "adaptive" {
+		log.Fatal().Msgf("STEADYBIT_EXTENSION_AWS_RETRY_MODE must be either 'standard' or 'adaptive'.")
+	}
+	if Config.DryRunFormat != DryRunFormatText && Config.DryRunFormat != DryRunFormatJson {
+		log.Fatal().Msgf("STEADYBIT_EXTENSION_DRY_RUN_FORMAT must be either '%s' or '%s'.", DryRunFormatText, DryRunFormatJson)
+	}
+	for _, pattern := range slices.Concat(Config.TaskFamilyAllowList, Config.TaskFamilyDenyList) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatal().Err(err).Msgf("Invalid task family pattern: %s", pattern)
+		}
+	}
 }
@@ -3,9 +3,111 @@
 
 package config
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 type Specification struct {
-	EcsClusterName    string   `json:"ecsClusterName" split_words:"true" required:"true"`
-	AgentKey          string   `json:"agentKey" split_words:"true" required:"true"`
-	DiscoveryInterval int      `json:"discoveryInterval" split_words:"true" required:"false" default:"30"`
-	TaskFamilies      []string `json:"taskFamilies" split_words:"true" required:"false" default:"steadybit-extension-host,steadybit-extension-container,steadybit-extension-http,steadybit-extension-aws"`
+	EcsClusterName            string      `json:"ecsClusterName" split_words:"true" required:"false"`
+	EcsClusters               EcsClusters `json:"ecsClusters" split_words:"true" required:"false"`
+	AgentKey                  string      `json:"agentKey" split_words:"true" required:"true"`
+	AgentUrl                  string      `json:"agentUrl" split_words:"true" required:"false" default:"http://localhost:42899"`
+	AgentCaFile               string      `json:"agentCaFile" split_words:"true" required:"false"`
+	AgentClientCertFile       string      `json:"agentClientCertFile" split_words:"true" required:"false"`
+	AgentClientKeyFile        string      `json:"agentClientKeyFile" split_words:"true" required:"false"`
+	AgentRequestTimeout       int         `json:"agentRequestTimeout" split_words:"true" required:"false" default:"10"`
+	AgentRetryCount           int         `json:"agentRetryCount" split_words:"true" required:"false" default:"3"`
+	AgentRetryWaitTime        int         `json:"agentRetryWaitTime" split_words:"true" required:"false" default:"1000"`
+	AgentRetryMaxWaitTime     int         `json:"agentRetryMaxWaitTime" split_words:"true" required:"false" default:"10000"`
+	AwsRequestTimeout         int         `json:"awsRequestTimeout" split_words:"true" required:"false" default:"10"`
+	AwsRetryMode              string      `json:"awsRetryMode" split_words:"true" required:"false" default:"adaptive"`
+	AwsRetryMaxAttempts       int         `json:"awsRetryMaxAttempts" split_words:"true" required:"false" default:"5"`
+	AwsCallBudget             int         `json:"awsCallBudget" split_words:"true" required:"false" default:"0"`
+	HostIpCacheTtl            int         `json:"hostIpCacheTtl" split_words:"true" required:"false" default:"300"`
+	DiscoveryInterval         int         `json:"discoveryInterval" split_words:"true" required:"false" default:"30"`
+	DiscoveryConcurrency      int         `json:"discoveryConcurrency" split_words:"true" required:"false" default:"4"`
+	TaskFamilies              []string    `json:"taskFamilies" split_words:"true" required:"false" default:"steadybit-extension-host,steadybit-extension-container,steadybit-extension-http,steadybit-extension-aws"`
+	DiscoveryMode             string      `json:"discoveryMode" split_words:"true" required:"false" default:"task-families"`
+	Services                  []string    `json:"services" split_words:"true" required:"false"`
+	TaskFamilyAllowList       []string    `json:"taskFamilyAllowList" split_words:"true" required:"false"`
+	TaskFamilyDenyList        []string    `json:"taskFamilyDenyList" split_words:"true" required:"false"`
+	RequireRunning            bool        `json:"requireRunning" split_words:"true" required:"false" default:"true"`
+	RequireHealthy            bool        `json:"requireHealthy" split_words:"true" required:"false" default:"false"`
+	AcceptUnknownHealth       bool        `json:"acceptUnknownHealth" split_words:"true" required:"false" default:"true"`
+	MetadataPrecedence        string      `json:"metadataPrecedence" split_words:"true" required:"false" default:"tags"`
+	EventQueueUrl             string      `json:"eventQueueUrl" split_words:"true" required:"false"`
+	HealthMaxSyncIntervals    int         `json:"healthMaxSyncIntervals" split_words:"true" required:"false" default:"3"`
+	HealthMaxAgentFailures    int         `json:"healthMaxAgentFailures" split_words:"true" required:"false" default:"3"`
+	HealthPort                int         `json:"healthPort" split_words:"true" required:"false" default:"8081"`
+	MetricsPort               int         `json:"metricsPort" split_words:"true" required:"false" default:"8082"`
+	DeregisterOnShutdown      bool        `json:"deregisterOnShutdown" split_words:"true" required:"false" default:"false"`
+	ManageAllRegistrations    bool        `json:"manageAllRegistrations" split_words:"true" required:"false" default:"false"`
+	OwnershipStateFile        string      `json:"ownershipStateFile" split_words:"true" required:"false" default:"/tmp/steadybit-auto-registration-ownership.json"`
+	DryRun                    bool        `json:"dryRun" split_words:"true" required:"false" default:"false"`
+	DryRunFormat              string      `json:"dryRunFormat" split_words:"true" required:"false" default:"text"`
+	ExtensionScheme           string      `json:"extensionScheme" split_words:"true" required:"false" default:"http"`
+	ExtensionTlsCheck         bool        `json:"extensionTlsCheck" split_words:"true" required:"false" default:"false"`
+	ExtensionProbe            bool        `json:"extensionProbe" split_words:"true" required:"false" default:"false"`
+	ExtensionProbePath        string      `json:"extensionProbePath" split_words:"true" required:"false" default:"/"`
+	ExtensionProbeTimeout     int         `json:"extensionProbeTimeout" split_words:"true" required:"false" default:"3"`
+	ExtensionProbeMaxFailures int         `json:"extensionProbeMaxFailures" split_words:"true" required:"false" default:"3"`
+}
+
+const (
+	// DiscoveryModeTaskFamilies lists the running tasks of the configured task families.
+	DiscoveryModeTaskFamilies = "task-families"
+	// DiscoveryModeTags lists all running tasks of the cluster or of the configured services and selects those tagged
+	// with `steadybit_extension_port`.
+	DiscoveryModeTags = "tags"
+)
+
+const (
+	// MetadataPrecedenceTags prefers the task tags over the docker labels of the container definitions.
+	MetadataPrecedenceTags = "tags"
+	// MetadataPrecedenceLabels prefers the docker labels of the container definitions over the task tags.
+	MetadataPrecedenceLabels = "labels"
+)
+
+const (
+	// DryRunFormatText logs the planned changes of a dry run.
+	DryRunFormatText = "text"
+	// DryRunFormatJson writes the planned changes of a dry run as one line of JSON per sync to stdout.
+	DryRunFormatJson = "json"
+)
+
+type EcsCluster struct {
+	Name    string `json:"name"`
+	Region  string `json:"region,omitempty"`
+	RoleArn string `json:"roleArn,omitempty"`
+}
+
+// EcsClusters is either configured as a JSON array of clusters, e.g. `[{"name":"a","region":"eu-west-1","roleArn":"arn:..."}]`,
+// or as a comma-separated list of cluster names using the default region and credentials.
+type EcsClusters []EcsCluster
+
+func (c *EcsClusters) Decode(value string) error {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		return json.Unmarshal([]byte(value), c)
+	}
+	clusters := make(EcsClusters, 0)
+	for name := range strings.SplitSeq(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			clusters = append(clusters, EcsCluster{Name: name})
+		}
+	}
+	*c = clusters
+	return nil
+}
+
+// GetEcsClusters returns the configured clusters, falling back to the single cluster configured via EcsClusterName.
+func (s *Specification) GetEcsClusters() []EcsCluster {
+	if len(s.EcsClusters) > 0 {
+		return s.EcsClusters
+	}
+	if s.EcsClusterName != "" {
+		return []EcsCluster{{Name: s.EcsClusterName}}
+	}
+	return nil
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog"
 	"github.com/steadybit/extension-auto-registration-ecs/autoregistration"
@@ -13,30 +17,112 @@ import (
 	"github.com/steadybit/extension-kit/extlogging"
 	"github.com/steadybit/extension-kit/extruntime"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+const (
+	shutdownTimeout = 20 * time.Second
+)
+
 func main() {
 	extlogging.InitZeroLog()
 	extbuild.PrintBuildInformation()
 	extruntime.LogRuntimeInformation(zerolog.DebugLevel)
 	extensionconfig.ParseConfiguration()
+	autoregistration.LoadOwnedRegistrations()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	httpClientAgent, err := autoregistration.NewAgentClient()
+	if err != nil {
+		log.Fatalf("failed to create agent client: %v", err)
+	}
+
+	clusters := make([]autoregistration.EcsCluster, 0)
+	for _, cluster := range extensionconfig.Config.GetEcsClusters() {
+		clusters = append(clusters, newEcsCluster(cluster))
+	}
+
+	if len(os.Args) > 1 {
+		exitCode := runCommand(ctx, os.Args[1:], httpClientAgent, clusters)
+		stop()
+		os.Exit(exitCode)
+	}
+
+	autoregistration.StartHealthMonitor(ctx, extensionconfig.Config.HealthPort)
+	autoregistration.StartMetricsServer(extensionconfig.Config.MetricsPort)
 
+	// Stays nil and therefore never receives if no event queue is configured
+	var events chan autoregistration.TaskStateChangeEvent
+	if extensionconfig.Config.EventQueueUrl != "" {
+		events = make(chan autoregistration.TaskStateChangeEvent)
+		go autoregistration.ReceiveTaskStateChangeEvents(ctx, newSqsClient(), extensionconfig.Config.EventQueueUrl, events)
+	}
+
+	discoveryInterval := time.Duration(extensionconfig.Config.DiscoveryInterval) * time.Second
+	//Wait before first discovery to give the agent time to start
+	nextSync := time.After(discoveryInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			shutdown(httpClientAgent)
+			return
+		case <-nextSync:
+			_ = autoregistration.UpdateAgentExtensions(ctx, httpClientAgent, clusters)
+			nextSync = time.After(discoveryInterval)
+		case event := <-events:
+			autoregistration.HandleTaskStateChangeEvent(ctx, httpClientAgent, clusters, event)
+		}
+	}
+}
+
+func shutdown(httpClientAgent *resty.Client) {
+	if !extensionconfig.Config.DeregisterOnShutdown {
+		return
+	}
+	// The root context is already cancelled, so the registrations are removed within a separate deadline
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	autoregistration.RemoveOwnedRegistrations(ctx, httpClientAgent)
+}
+
+func newSqsClient() *autoregistration.SqsApi {
 	awsCfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
-		log.Fatalf("failed to load AWS configuration: %v", err)
+		log.Fatalf("failed to load AWS configuration for event queue: %v", err)
 	}
+	var sqsClient autoregistration.SqsApi = sqs.NewFromConfig(awsCfg)
+	return &sqsClient
+}
 
-	httpClientAgent := resty.New()
-	httpClientAgent.BaseURL = "http://localhost:42899"
-	httpClientAgent.SetDisableWarn(true)
+func newEcsCluster(cluster extensionconfig.EcsCluster) autoregistration.EcsCluster {
+	var opts []func(*config.LoadOptions) error
+	if cluster.Region != "" {
+		opts = append(opts, config.WithRegion(cluster.Region))
+	}
+	opts = append(opts,
+		config.WithRetryMode(aws.RetryMode(extensionconfig.Config.AwsRetryMode)),
+		config.WithRetryMaxAttempts(extensionconfig.Config.AwsRetryMaxAttempts),
+	)
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		log.Fatalf("failed to load AWS configuration for cluster %s: %v", cluster.Name, err)
+	}
+	if cluster.RoleArn != "" {
+		awsCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cluster.RoleArn))
+	}
+	// Added after creating the STS client, so only the discovery calls count against the call budget
+	awsCfg.APIOptions = append(awsCfg.APIOptions, autoregistration.AwsApiOptions()...)
 
 	var ecsClient autoregistration.EcsApi = ecs.NewFromConfig(awsCfg)
 	var ec2Client autoregistration.Ec2Api = ec2.NewFromConfig(awsCfg)
-
-	for {
-		//Sleep before first discovery to give the agent time to start
-		time.Sleep(time.Duration(extensionconfig.Config.DiscoveryInterval) * time.Second)
-		autoregistration.UpdateAgentExtensions(httpClientAgent, &ecsClient, &ec2Client)
+	return autoregistration.EcsCluster{
+		Name:      cluster.Name,
+		EcsClient: &ecsClient,
+		Ec2Client: &ec2Client,
 	}
 }